@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	// 每条记录一行 JSON
+	AccessLogJSON AccessLogFormat = iota
+	// 类似 Common Log Format 的文本：
+	// client - user [start] "COMMAND dest" reply bytes_in bytes_out duration resolved_ip "reason"
+	AccessLogCommon
+)
+
+// DefaultAccessLogBackups 是轮转后默认保留的旧文件数
+const DefaultAccessLogBackups = 5
+
+// AccessRecord 是一次会话结束时的访问日志记录
+type AccessRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// 客户端地址
+	Client string `json:"client"`
+	// 认证后的用户名，未认证时为空
+	User    string `json:"user,omitempty"`
+	Command string `json:"command"`
+	// 客户端请求的目标地址
+	Dest string `json:"dest"`
+	// 直连时实际连接的目标 IP
+	ResolvedIP string `json:"resolved_ip,omitempty"`
+	// 最后一次发送的应答码，-1 表示没有应答
+	Reply int `json:"reply"`
+	// 客户端发往目标的字节数
+	BytesIn uint64 `json:"bytes_in"`
+	// 目标发往客户端的字节数
+	BytesOut    uint64 `json:"bytes_out"`
+	CloseReason string `json:"close_reason"`
+}
+
+// AccessLog 将会话记录追加到文件，文件超过 MaxSize 后轮转为 Filename.1、Filename.2 ...
+type AccessLog struct {
+	Filename string
+	Format   AccessLogFormat
+	// 单个文件的最大字节数，为 0 时不轮转
+	MaxSize int64
+	// 保留的旧文件数，为 0 时使用 DefaultAccessLogBackups
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Write 写入一条记录
+func (l *AccessLog) Write(r *AccessRecord) error {
+	line, err := l.format(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close 关闭当前文件，之后的 Write 会重新打开
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AccessLog) format(r *AccessRecord) ([]byte, error) {
+	if l.Format == AccessLogJSON {
+		b, err := json.Marshal(r)
+		return append(b, '\n'), err
+	}
+	host, _, err := net.SplitHostPort(r.Client)
+	if err != nil {
+		host = r.Client
+	}
+	reply := "-"
+	if r.Reply >= 0 {
+		reply = strconv.Itoa(r.Reply)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s\" %s %d %d %s %s %q\n",
+		host, orDash(r.User), r.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Command, r.Dest, reply, r.BytesIn, r.BytesOut,
+		r.End.Sub(r.Start).Round(time.Millisecond), orDash(r.ResolvedIP), r.CloseReason)
+	return []byte(line), nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate 将现有文件依次后移一位，超出 MaxBackups 的旧文件被删除
+func (l *AccessLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	backups := l.MaxBackups
+	if backups == 0 {
+		backups = DefaultAccessLogBackups
+	}
+	os.Remove(backupName(l.Filename, backups))
+	for i := backups - 1; i >= 1; i-- {
+		err := os.Rename(backupName(l.Filename, i), backupName(l.Filename, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.Filename, backupName(l.Filename, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func backupName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
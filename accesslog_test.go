@@ -0,0 +1,133 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAccessLog(t *testing.T, name string) []AccessRecord {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AccessRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r AccessRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("unmarshal %q: %v", sc.Bytes(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAccessLogSessions(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	name := filepath.Join(t.TempDir(), "access.log")
+	target := echo.Addr().(*net.TCPAddr)
+	s := &SOCKS5Server{
+		AccessLog: &AccessLog{Filename: name},
+		Rules: Rules{
+			{Action: RuleDeny, Ports: []PortRange{{From: 9, To: 9}}},
+			{Action: RuleAllow},
+		},
+	}
+	defer s.AccessLog.Close()
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, target)
+	echoRoundTrip(t, conn)
+	conn.Close()
+
+	denied, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied.Write([]byte{SOCKS5Version, 1, NoAuth})
+	denied.Write([]byte{SOCKS5Version, Connect, 0x00, IPv4, 127, 0, 0, 1, 0, 9})
+	denied.Read(make([]byte, 12))
+	denied.Close()
+	waitFor(t, func() bool { return s.activeConns() == 0 })
+
+	records := readAccessLog(t, name)
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	var ok, rejected AccessRecord
+	for _, r := range records {
+		if r.Reply == int(successReply) {
+			ok = r
+		} else {
+			rejected = r
+		}
+	}
+	if ok.Command != "connect" || ok.Dest != target.String() || ok.ResolvedIP != "127.0.0.1" ||
+		ok.BytesIn != 4 || ok.BytesOut != 4 || ok.CloseReason != "closed" || ok.End.Before(ok.Start) {
+		t.Errorf("tunnel record = %+v", ok)
+	}
+	if rejected.Reply != int(ruleFailure) || rejected.CloseReason != ErrRuleFailure.Error() {
+		t.Errorf("denied record = %+v", rejected)
+	}
+}
+
+func TestAccessLogCommonFormat(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	l := &AccessLog{Filename: name, Format: AccessLogCommon}
+	defer l.Close()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	err := l.Write(&AccessRecord{
+		Start:       start,
+		End:         start.Add(1500 * time.Millisecond),
+		Client:      "203.0.113.7:40000",
+		User:        "alice",
+		Command:     "connect",
+		Dest:        "example.com:443",
+		ResolvedIP:  "93.184.216.34",
+		Reply:       0,
+		BytesIn:     10,
+		BytesOut:    20,
+		CloseReason: "closed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(name)
+	want := `203.0.113.7 - alice [01/Mar/2024:12:00:00 +0000] "connect example.com:443" 0 10 20 1.5s 93.184.216.34 "closed"` + "\n"
+	if string(got) != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	l := &AccessLog{Filename: name, MaxSize: 500, MaxBackups: 2}
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		if err := l.Write(&AccessRecord{Client: "127.0.0.1:1", Command: "connect", Dest: strings.Repeat("x", 50)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []string{name, name + ".1", name + ".2"} {
+		fi, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > l.MaxSize {
+			t.Errorf("%s size = %d, want <= %d", n, fi.Size(), l.MaxSize)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want at most 2 backups", name)
+	}
+}
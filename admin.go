@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// AdminHandler 返回管理接口：
+//
+//	GET    /metrics        Prometheus 文本格式的指标
+//	GET    /sessions       活动会话列表，可用 user 和 client 参数过滤
+//	DELETE /sessions       结束 user 或 client 参数匹配的会话，两者至少指定一个
+//	DELETE /sessions/{id}  结束指定会话
+func (s *SOCKS5Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.writeTo(w)
+	})
+	mux.HandleFunc("GET /sessions", s.listSessions)
+	mux.HandleFunc("DELETE /sessions", s.killSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", s.killSession)
+	return mux
+}
+
+func (s *SOCKS5Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	match := sessionFilter(r)
+	sessions := []SessionInfo{}
+	for _, info := range s.Sessions() {
+		if match(info) {
+			sessions = append(sessions, info)
+		}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *SOCKS5Server) killSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("user") == "" && q.Get("client") == "" {
+		http.Error(w, "user or client is required", http.StatusBadRequest)
+		return
+	}
+	n := s.KillSessions(sessionFilter(r))
+	writeJSON(w, http.StatusOK, map[string]int{"killed": n})
+}
+
+func (s *SOCKS5Server) killSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	if !s.KillSession(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"killed": 1})
+}
+
+// sessionFilter 按 user 和 client（客户端 IP）查询参数匹配会话，参数为空时不限制
+func sessionFilter(r *http.Request) func(SessionInfo) bool {
+	user := r.URL.Query().Get("user")
+	clientIP := net.ParseIP(r.URL.Query().Get("client"))
+	hasClient := r.URL.Query().Get("client") != ""
+	return func(info SessionInfo) bool {
+		if user != "" && info.User != user {
+			return false
+		}
+		if hasClient {
+			host, _, err := net.SplitHostPort(info.Client)
+			if err != nil || clientIP == nil || !clientIP.Equal(net.ParseIP(host)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, s *SOCKS5Server, method, target string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminSessions(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Credentials: StaticCredentials{"alice": "a", "bob": "b"}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	alice1, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "a"}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice1.Close()
+	alice2, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "a"}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice2.Close()
+	bob, err := (&Client{ProxyAddr: addr, Username: "bob", Password: "b"}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	echoRoundTrip(t, bob)
+
+	var sessions []SessionInfo
+	if code := adminRequest(t, s, http.MethodGet, "/sessions", &sessions); code != http.StatusOK || len(sessions) != 3 {
+		t.Fatalf("GET /sessions = %v, %d sessions, want 3", code, len(sessions))
+	}
+	var bobs []SessionInfo
+	//写回客户端的字节在客户端读到后才计入
+	waitFor(t, func() bool {
+		adminRequest(t, s, http.MethodGet, "/sessions?user=bob", &bobs)
+		return len(bobs) == 1 && bobs[0].BytesOut == 4
+	})
+	if bobs[0].Dest != echo.Addr().String() || bobs[0].BytesIn != 4 {
+		t.Fatalf("GET /sessions?user=bob = %+v", bobs)
+	}
+
+	if code := adminRequest(t, s, http.MethodDelete, "/sessions", nil); code != http.StatusBadRequest {
+		t.Errorf("DELETE /sessions without filter = %v, want %v", code, http.StatusBadRequest)
+	}
+	var killed map[string]int
+	adminRequest(t, s, http.MethodDelete, "/sessions?user=alice&client=127.0.0.1", &killed)
+	if killed["killed"] != 2 {
+		t.Errorf("killed = %v, want 2", killed)
+	}
+	alice1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := alice1.Read(make([]byte, 1)); err == nil {
+		t.Error("killed session still readable")
+	}
+
+	if code := adminRequest(t, s, http.MethodDelete, "/sessions/999", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE unknown session = %v, want %v", code, http.StatusNotFound)
+	}
+	if code := adminRequest(t, s, http.MethodDelete, "/sessions/"+strconv.FormatUint(bobs[0].ID, 10), &killed); code != http.StatusOK {
+		t.Errorf("DELETE /sessions/%d = %v", bobs[0].ID, code)
+	}
+	waitFor(t, func() bool { return len(s.Sessions()) == 0 })
+}
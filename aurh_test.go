@@ -1,67 +1,159 @@
-package socks5
-
-import (
-	"bytes"
-	"net"
-	"testing"
-	"time"
-)
-
-type mockConn struct {
-    net.Conn
-    buf *bytes.Buffer
-}
-
-func (m *mockConn) Read(b []byte) (int, error) {
-    return m.buf.Read(b)
-}
-
-func (m *mockConn) Write(b []byte) (int, error) {
-    return m.buf.Write(b)
-}
-
-func (m *mockConn) Close() error {
-    return nil
-}
-
-func (m *mockConn) LocalAddr() net.Addr {
-    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
-}
-
-func (m *mockConn) RemoteAddr() net.Addr {
-    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
-}
-
-func (m *mockConn) SetDeadline(t time.Time) error {
-    return nil
-}
-
-func (m *mockConn) SetReadDeadline(t time.Time) error {
-    return nil
-}
-
-func (m *mockConn) SetWriteDeadline(t time.Time) error {
-    return nil
-}
-
-func TestNewClientAuthMassage(t *testing.T) {
-    data := []byte{SOCKS5Version, 1, 0x00} // Version 5, 1 method, method 0x00
-    conn := &mockConn{buf: bytes.NewBuffer(data)}
-
-    authMsg, err := NewClientAuthMassage(conn)
-    if err != nil {
-        t.Fatalf("expected no error, got %v", err)
-    }
-
-    if authMsg.Version != SOCKS5Version {
-        t.Errorf("expected version %v, got %v", SOCKS5Version, authMsg.Version)
-    }
-
-    if authMsg.NMethods != 1 {
-        t.Errorf("expected 1 method, got %v", authMsg.NMethods)
-    }
-
-    if len(authMsg.Methods) != 1 || authMsg.Methods[0] != 0x00 {
-        t.Errorf("expected method 0x00, got %v", authMsg.Methods)
-    }
-}
\ No newline at end of file
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type mockConn struct {
+    net.Conn
+    buf *bytes.Buffer
+    // 非空时写入 out 而不是 buf
+    out *bytes.Buffer
+}
+
+func (m *mockConn) Read(b []byte) (int, error) {
+    return m.buf.Read(b)
+}
+
+func (m *mockConn) Write(b []byte) (int, error) {
+    if m.out != nil {
+        return m.out.Write(b)
+    }
+    return m.buf.Write(b)
+}
+
+func (m *mockConn) Close() error {
+    return nil
+}
+
+func (m *mockConn) LocalAddr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func (m *mockConn) RemoteAddr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func (m *mockConn) SetDeadline(t time.Time) error {
+    return nil
+}
+
+func (m *mockConn) SetReadDeadline(t time.Time) error {
+    return nil
+}
+
+func (m *mockConn) SetWriteDeadline(t time.Time) error {
+    return nil
+}
+
+func TestNewClientAuthMassage(t *testing.T) {
+    data := []byte{SOCKS5Version, 1, 0x00} // Version 5, 1 method, method 0x00
+    conn := &mockConn{buf: bytes.NewBuffer(data)}
+
+    authMsg, err := NewClientAuthMassage(conn)
+    if err != nil {
+        t.Fatalf("expected no error, got %v", err)
+    }
+
+    if authMsg.Version != SOCKS5Version {
+        t.Errorf("expected version %v, got %v", SOCKS5Version, authMsg.Version)
+    }
+
+    if authMsg.NMethods != 1 {
+        t.Errorf("expected 1 method, got %v", authMsg.NMethods)
+    }
+
+    if len(authMsg.Methods) != 1 || authMsg.Methods[0] != 0x00 {
+        t.Errorf("expected method 0x00, got %v", authMsg.Methods)
+    }
+}
+func TestNewClientPasswordMassage(t *testing.T) {
+	data := []byte{PasswordVersion, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	conn := &mockConn{buf: bytes.NewBuffer(data)}
+
+	msg, err := NewClientPasswordMassage(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if msg.Username != "user" || msg.Password != "pass" {
+		t.Errorf("expected user/pass, got %v/%v", msg.Username, msg.Password)
+	}
+
+	conn = &mockConn{buf: bytes.NewBuffer([]byte{0x05, 4, 'u', 's', 'e', 'r'})}
+	if _, err := NewClientPasswordMassage(conn); err != ErrPasswordVersion {
+		t.Errorf("expected %v, got %v", ErrPasswordVersion, err)
+	}
+}
+
+func TestAuthUserPassword(t *testing.T) {
+	s := &SOCKS5Server{Credentials: StaticCredentials{"user": "pass"}}
+	tests := []struct {
+		name      string
+		input     []byte
+		wantReply []byte
+		wantErr   bool
+	}{
+		{
+			name:      "Success",
+			input:     []byte{SOCKS5Version, 2, NoAuth, UserPassword, PasswordVersion, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'},
+			wantReply: []byte{SOCKS5Version, UserPassword, PasswordVersion, PasswordSuccess},
+		},
+		{
+			name:      "Wrong password",
+			input:     []byte{SOCKS5Version, 1, UserPassword, PasswordVersion, 4, 'u', 's', 'e', 'r', 4, 'b', 'a', 'd', '!'},
+			wantReply: []byte{SOCKS5Version, UserPassword, PasswordVersion, PasswordFailure},
+			wantErr:   true,
+		},
+		{
+			name:      "No acceptable method",
+			input:     []byte{SOCKS5Version, 1, NoAuth},
+			wantReply: []byte{SOCKS5Version, NoAcceptable},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConn{buf: bytes.NewBuffer(tt.input)}
+			_, err := s.auth(conn)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := conn.buf.Bytes(); !bytes.Equal(got, tt.wantReply) {
+				t.Errorf("auth() = %v, want %v", got, tt.wantReply)
+			}
+		})
+	}
+}
+
+type privateAuthenticator struct{}
+
+func (a privateAuthenticator) Method() Method {
+	return 0x80
+}
+
+func (a privateAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	return "private", nil
+}
+
+func TestAuthServerPreference(t *testing.T) {
+	s := &SOCKS5Server{Authenticators: []Authenticator{
+		privateAuthenticator{},
+		NoAuthAuthenticator{},
+	}}
+	conn := &mockConn{buf: bytes.NewBuffer([]byte{SOCKS5Version, 2, NoAuth, 0x80})}
+
+	user, err := s.auth(conn)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if user != "private" {
+		t.Errorf("expected user private, got %v", user)
+	}
+	if got := conn.buf.Bytes(); !bytes.Equal(got, []byte{SOCKS5Version, 0x80}) {
+		t.Errorf("auth() = %v, want %v", got, []byte{SOCKS5Version, 0x80})
+	}
+}
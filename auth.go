@@ -1,64 +1,217 @@
-package socks5
-
-import (
-	"io"
-	"net"
-	"errors"
-)
-const (
-	SOCKS5Version = 0x05
-	ReservedFeild = 0x00
-)
-
-const (
-	NoAuth          = 0x00
-	GSSAPI          = 0x01
-	NoAcceptable    = 0xff
-	UserPassword    = 0x02
-)
-
-var ErrVersion = errors.New("invalid version")
-var ErrInvalidMethod = errors.New("invalid method")
-var ErrInvaildReservedField = errors.New("invalid reserved field")
-var ErrInvalidAddressType = errors.New("invalid address type")
-var ErrInvalidPort = errors.New("invalid port")
-var ErrUnsupportedCommand = errors.New("unsupported command")
-
-type Method = byte
-
-
-type ClientAuthMassage struct {
-	Version  byte
-	NMethods byte
-	Methods  []Method
-}
-
-func NewClientAuthMassage(conn net.Conn) (*ClientAuthMassage, error) {
-	//读取版本和方法数
-	buf := make([]byte, 2)
-	_, err := io.ReadFull(conn, buf)
-	if err != nil {
-		return nil, err
-	}
-	if buf[0] != SOCKS5Version {
-		return nil, ErrVersion
-	}
-	//读取方法
-	nMethods := buf[1]
-	buf = make([]byte, nMethods)
-	_, err = io.ReadFull(conn, buf)
-	if err != nil {
-		return nil, err
-	}
-	return &ClientAuthMassage{
-		Version: SOCKS5Version,
-		NMethods: nMethods,
-		Methods: buf,
-	}, nil
-}
-
-func NewServerAuthMassage(conn net.Conn, method Method) error {
-	buf := []byte{SOCKS5Version, method}
-	_, err := conn.Write(buf)
-	return err
-}
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	SOCKS5Version = 0x05
+	ReservedFeild = 0x00
+)
+
+const (
+	NoAuth       = 0x00
+	GSSAPI       = 0x01
+	NoAcceptable = 0xff
+	UserPassword = 0x02
+)
+
+// RFC 1929 用户名/密码子协商
+const (
+	PasswordVersion = 0x01
+	PasswordSuccess = 0x00
+	PasswordFailure = 0x01
+)
+
+var ErrVersion = errors.New("invalid version")
+var ErrInvalidMethod = errors.New("invalid method")
+var ErrNoAcceptableMethod = errors.New("no acceptable authentication method")
+var ErrInvaildReservedField = errors.New("invalid reserved field")
+var ErrInvalidAddressType = errors.New("invalid address type")
+var ErrInvalidPort = errors.New("invalid port")
+var ErrUnsupportedCommand = errors.New("unsupported command")
+var ErrPasswordVersion = errors.New("invalid password auth version")
+var ErrPasswordAuthFailure = errors.New("invalid username or password")
+
+type Method = byte
+
+type ClientAuthMassage struct {
+	Version  byte
+	NMethods byte
+	Methods  []Method
+}
+
+type ClientPasswordMassage struct {
+	Version  byte
+	Username string
+	Password string
+}
+
+// CredentialStore 校验用户名/密码
+type CredentialStore interface {
+	Valid(username, password string) bool
+}
+
+// Authenticator 实现一种认证方法，Authenticate 在方法协商之后执行并返回用户身份
+type Authenticator interface {
+	Method() Method
+	Authenticate(conn net.Conn) (string, error)
+}
+
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) Method() Method {
+	return NoAuth
+}
+
+func (a NoAuthAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	return "", nil
+}
+
+type UserPassAuthenticator struct {
+	Credentials CredentialStore
+}
+
+func (a UserPassAuthenticator) Method() Method {
+	return UserPassword
+}
+
+func (a UserPassAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	clientMessage, err := NewClientPasswordMassage(conn)
+	if err != nil {
+		return "", err
+	}
+	if !a.Credentials.Valid(clientMessage.Username, clientMessage.Password) {
+		NewServerPasswordMassage(conn, PasswordFailure)
+		return "", ErrPasswordAuthFailure
+	}
+	return clientMessage.Username, NewServerPasswordMassage(conn, PasswordSuccess)
+}
+
+// StaticCredentials 用户名到密码的静态映射
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) Valid(username, password string) bool {
+	pass, ok := s[username]
+	return ok && pass == password
+}
+
+func NewClientAuthMassage(conn net.Conn) (*ClientAuthMassage, error) {
+	//读取版本和方法数
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != SOCKS5Version {
+		return nil, ErrVersion
+	}
+	//读取方法
+	nMethods := buf[1]
+	buf = make([]byte, nMethods)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientAuthMassage{
+		Version:  SOCKS5Version,
+		NMethods: nMethods,
+		Methods:  buf,
+	}, nil
+}
+
+func NewServerAuthMassage(conn net.Conn, method Method) error {
+	buf := []byte{SOCKS5Version, method}
+	_, err := conn.Write(buf)
+	return err
+}
+
+func NewClientPasswordMassage(conn net.Conn) (*ClientPasswordMassage, error) {
+	//读取版本和用户名长度
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != PasswordVersion {
+		return nil, ErrPasswordVersion
+	}
+	//读取用户名
+	buf = make([]byte, buf[1])
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	username := string(buf)
+	//读取密码
+	buf = make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = make([]byte, buf[0])
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientPasswordMassage{
+		Version:  PasswordVersion,
+		Username: username,
+		Password: string(buf),
+	}, nil
+}
+
+func NewServerPasswordMassage(conn net.Conn, status byte) error {
+	buf := []byte{PasswordVersion, status}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// 以下为客户端使用的编码与解析
+
+func (m *ClientAuthMassage) Send(conn net.Conn) error {
+	buf := []byte{SOCKS5Version, byte(len(m.Methods))}
+	buf = append(buf, m.Methods...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// ReadServerAuthMassage 读取服务端选择的认证方法
+func ReadServerAuthMassage(conn net.Conn) (Method, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return 0, err
+	}
+	if buf[0] != SOCKS5Version {
+		return 0, ErrVersion
+	}
+	return buf[1], nil
+}
+
+func (m *ClientPasswordMassage) Send(conn net.Conn) error {
+	if len(m.Username) > 255 || len(m.Password) > 255 {
+		return ErrPasswordAuthFailure
+	}
+	buf := []byte{PasswordVersion, byte(len(m.Username))}
+	buf = append(buf, m.Username...)
+	buf = append(buf, byte(len(m.Password)))
+	buf = append(buf, m.Password...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// ReadServerPasswordMassage 读取用户名/密码认证的结果
+func ReadServerPasswordMassage(conn net.Conn) (byte, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return 0, err
+	}
+	if buf[0] != PasswordVersion {
+		return 0, ErrPasswordVersion
+	}
+	return buf[1], nil
+}
@@ -0,0 +1,318 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrUnsupportedNetwork = errors.New("socks5: unsupported network")
+
+// Client 通过 SOCKS5 代理建立连接，DialContext 满足 proxy.ContextDialer
+type Client struct {
+	// 代理服务器地址
+	ProxyAddr string
+	// Username 非空时使用用户名/密码认证
+	Username string
+	Password string
+	// 连接代理服务器使用的拨号函数，为空时使用 net.Dialer
+	Forward DialFunc
+}
+
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrUnsupportedNetwork
+	}
+	req, err := NewClientRequestMassageFromAddress(Connect, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := c.request(ctx, req)
+	return conn, err
+}
+
+// request 连接代理、完成认证并发送请求，返回控制连接和第一次应答中的地址
+func (c *Client) request(ctx context.Context, req *ClientRequestMassage) (net.Conn, *AddrSpec, error) {
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := c.handshakeContext(ctx, conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, addr, nil
+}
+
+// handshakeContext 在 conn 上执行 handshake，期间遵守 ctx 的截止时间和取消
+func (c *Client) handshakeContext(ctx context.Context, conn net.Conn, req *ClientRequestMassage) (*AddrSpec, error) {
+	var addr *AddrSpec
+	err := withConnContext(ctx, conn, func() error {
+		var err error
+		addr, err = c.handshake(conn, req)
+		return err
+	})
+	return addr, err
+}
+
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	if c.Forward != nil {
+		return c.Forward(ctx, "tcp", c.ProxyAddr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", c.ProxyAddr)
+}
+
+func (c *Client) handshake(conn net.Conn, req *ClientRequestMassage) (*AddrSpec, error) {
+	//协商
+	methods := []Method{NoAuth}
+	if c.Username != "" {
+		methods = []Method{UserPassword, NoAuth}
+	}
+	err := (&ClientAuthMassage{Methods: methods}).Send(conn)
+	if err != nil {
+		return nil, err
+	}
+	method, err := ReadServerAuthMassage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case NoAuth:
+	case UserPassword:
+		if c.Username == "" {
+			return nil, ErrInvalidMethod
+		}
+		msg := &ClientPasswordMassage{Username: c.Username, Password: c.Password}
+		if err := msg.Send(conn); err != nil {
+			return nil, err
+		}
+		status, err := ReadServerPasswordMassage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if status != PasswordSuccess {
+			return nil, ErrPasswordAuthFailure
+		}
+	default:
+		return nil, ErrInvalidMethod
+	}
+	//请求
+	if err := req.Send(conn); err != nil {
+		return nil, err
+	}
+	rep, addr, err := ReadReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep != successReply {
+		return nil, &ReplyError{Code: rep}
+	}
+	return addr, nil
+}
+
+// ListenPacket 通过 UDP ASSOCIATE 返回一个经代理收发数据报的 net.PacketConn，
+// 控制连接断开时 PacketConn 随之关闭
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	conn, err := c.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//在控制连接的本地地址上监听，并向代理声明该地址
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req, err := NewClientRequestMassageFromAddress(UDPAssociate, udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		conn.Close()
+		return nil, err
+	}
+	bndAddr, err := c.handshakeContext(ctx, conn, req)
+	if err != nil {
+		udpConn.Close()
+		conn.Close()
+		return nil, err
+	}
+	return newUDPPacketConn(udpConn, conn, bndAddr), nil
+}
+
+func newUDPPacketConn(udpConn *net.UDPConn, ctrl net.Conn, bndAddr *AddrSpec) *udpPacketConn {
+	//BND.ADDR 为全零地址时使用代理服务器的地址
+	relay := &net.UDPAddr{IP: bndAddr.IP, Port: bndAddr.Port}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if addr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = addr.IP
+		}
+	}
+	pc := &udpPacketConn{conn: udpConn, ctrl: ctrl, relay: relay}
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+	return pc
+}
+
+// udpPacketConn 在数据报前后添加/去除 SOCKS5 UDP 头
+type udpPacketConn struct {
+	conn  *net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+// fqdnAddr 表示代理返回的域名形式的来源地址
+type fqdnAddr struct {
+	network string
+	address string
+}
+
+func (a *fqdnAddr) Network() string { return a.network }
+func (a *fqdnAddr) String() string  { return a.address }
+
+func (p *udpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, MaxSegmentSize)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(p.relay.IP) || from.Port != p.relay.Port {
+			//只接受代理中继发来的数据报
+			continue
+		}
+		d, err := NewUDPDatagramFromBytes(buf[:n])
+		if err != nil || d.Frag != 0 {
+			continue
+		}
+		var addr net.Addr = &fqdnAddr{network: "udp", address: d.Address()}
+		if d.AType != DomainName {
+			addr = &net.UDPAddr{IP: net.IP(d.DstAddr), Port: int(binary.BigEndian.Uint16(d.DstPort))}
+		}
+		return copy(b, d.Data), addr, nil
+	}
+}
+
+func (p *udpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	bAddr, err := NewAddrByteFromString(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	_, err = p.conn.WriteTo(NewUDPDatagram(bAddr, b).ToBytes(), p.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *udpPacketConn) Close() error {
+	p.ctrl.Close()
+	return p.conn.Close()
+}
+
+func (p *udpPacketConn) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *udpPacketConn) SetDeadline(t time.Time) error {
+	return p.conn.SetDeadline(t)
+}
+
+func (p *udpPacketConn) SetReadDeadline(t time.Time) error {
+	return p.conn.SetReadDeadline(t)
+}
+
+func (p *udpPacketConn) SetWriteDeadline(t time.Time) error {
+	return p.conn.SetWriteDeadline(t)
+}
+
+var ErrBindAccepted = errors.New("socks5: bind connection already accepted")
+
+// Bind 发送 BIND 请求，address 为预期对端的地址。返回的 BindListener
+// 的 Addr 是需要告知对端的代理地址，Accept 等待第二次应答并返回数据流
+func (c *Client) Bind(ctx context.Context, address string) (*BindListener, error) {
+	req, err := NewClientRequestMassageFromAddress(Bind, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, bndAddr, err := c.request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.TCPAddr{IP: bndAddr.IP, Port: bndAddr.Port}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		if raddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			addr.IP = raddr.IP
+		}
+	}
+	return &BindListener{conn: conn, addr: addr}, nil
+}
+
+// BindListener 实现 net.Listener，只能 Accept 一个连接
+type BindListener struct {
+	conn     net.Conn
+	addr     *net.TCPAddr
+	mu       sync.Mutex
+	accepted bool
+}
+
+func (l *BindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.accepted {
+		return nil, ErrBindAccepted
+	}
+	l.accepted = true
+	rep, peer, err := ReadReply(l.conn)
+	if err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+	if rep != successReply {
+		l.conn.Close()
+		return nil, &ReplyError{Code: rep}
+	}
+	return &bindConn{Conn: l.conn, remote: &net.TCPAddr{IP: peer.IP, Port: peer.Port}}, nil
+}
+
+// Close 在 Accept 之前调用时放弃 BIND，之后调用不影响已返回的连接
+func (l *BindListener) Close() error {
+	if l.mu.TryLock() {
+		defer l.mu.Unlock()
+		if l.accepted {
+			return nil
+		}
+		l.accepted = true
+	}
+	return l.conn.Close()
+}
+
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn 的 RemoteAddr 为连接到代理的对端地址
+type bindConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,220 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func echoRoundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+}
+
+func TestClientDial(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+	s := &SOCKS5Server{Resolver: staticResolver{"echo.test": net.IPv4(127, 0, 0, 1)}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+	c := &Client{ProxyAddr: addr}
+
+	for _, target := range []string{echo.Addr().String(), net.JoinHostPort("echo.test", strconv.Itoa(port))} {
+		conn, err := c.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext(%s) error = %v", target, err)
+		}
+		echoRoundTrip(t, conn)
+		conn.Close()
+	}
+}
+
+func TestClientDialIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	defer l.Close()
+
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn)
+}
+
+func TestClientUserPassword(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Credentials: StaticCredentials{"user": "pass"}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := (&Client{ProxyAddr: addr, Username: "user", Password: "pass"}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	echoRoundTrip(t, conn)
+	conn.Close()
+
+	_, err = (&Client{ProxyAddr: addr, Username: "user", Password: "bad"}).Dial("tcp", echo.Addr().String())
+	if err != ErrPasswordAuthFailure {
+		t.Errorf("Dial() error = %v, want %v", err, ErrPasswordAuthFailure)
+	}
+	_, err = (&Client{ProxyAddr: addr}).Dial("tcp", echo.Addr().String())
+	if err != ErrInvalidMethod {
+		t.Errorf("Dial() error = %v, want %v", err, ErrInvalidMethod)
+	}
+}
+
+func TestClientReplyError(t *testing.T) {
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleDeny}}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	_, err := (&Client{ProxyAddr: addr}).Dial("tcp", "127.0.0.1:9")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != ruleFailure {
+		t.Errorf("Dial() error = %v, want rule failure", err)
+	}
+}
+
+func TestClientHTTPTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	c := &Client{ProxyAddr: addr}
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: c.DialContext}}
+	resp, err := httpClient.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want hello", body)
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	pc, err := (&Client{ProxyAddr: addr}).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer pc.Close()
+
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != echo.LocalAddr().String() {
+		t.Errorf("ReadFrom() = %q from %v", buf[:n], from)
+	}
+
+	//控制连接断开后 PacketConn 应关闭
+	s.Close()
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom() after server close error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestClientBind(t *testing.T) {
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	l, err := (&Client{ProxyAddr: addr}).Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	defer l.Close()
+
+	peer, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial bind address %v: %v", l.Addr(), err)
+	}
+	defer peer.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+		t.Errorf("RemoteAddr() = %v, want %v", conn.RemoteAddr(), peer.LocalAddr())
+	}
+	peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+	if _, err := l.Accept(); err != ErrBindAccepted {
+		t.Errorf("second Accept() error = %v, want %v", err, ErrBindAccepted)
+	}
+}
+
+func TestClientBindClose(t *testing.T) {
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	l, err := (&Client{ProxyAddr: addr}).Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errCh <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("Accept() after Close returned no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept() not unblocked by Close")
+	}
+}
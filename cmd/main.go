@@ -1,19 +1,19 @@
-package main
-
-import (
-	"log"
-
-	"github.com/van/socks5"
-)
-
-func main() {
-	server := socks5.SOCKS5Server{
-		IP:"localhost",
-		Port: 1080,
-	}
-	err := server.Run()
-	if err != nil {
-		log.Fatal(err)
-	}
-	
+package main
+
+import (
+	"log"
+
+	"github.com/van/socks5"
+)
+
+func main() {
+	server := socks5.SOCKS5Server{
+		IP:"localhost",
+		Port: 1080,
+	}
+	err := server.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+	
 }
\ No newline at end of file
@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DialFunc 建立出站连接
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (s *SOCKS5Server) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	if s.Dial != nil {
+		return s.Dial(ctx, network, address)
+	}
+	d := &net.Dialer{KeepAlive: s.KeepAlive}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	localIP, err := s.outboundIP(ip != nil && ip.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// outboundIP 返回出站连接应绑定的本地地址，未配置时返回 nil
+func (s *SOCKS5Server) outboundIP(ipv6 bool) (net.IP, error) {
+	if s.OutboundIP != nil {
+		//地址族与目标不同时不绑定
+		if (s.OutboundIP.To4() == nil) != ipv6 {
+			return nil, nil
+		}
+		return s.OutboundIP, nil
+	}
+	if s.OutboundInterface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(s.OutboundInterface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	if ip := interfaceIP(addrs, ipv6); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", s.OutboundInterface)
+}
+
+// interfaceIP 返回 addrs 中与目标地址族相同的第一个地址。链路本地地址不带 zone
+// 无法绑定后访问其他网段，跳过
+func interfaceIP(addrs []net.Addr, ipv6 bool) net.IP {
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipNet.IP.To4() == nil) == ipv6 {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
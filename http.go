@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 逐跳头部，转发时删除
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 认证失败时为保持连接最多丢弃的请求体字节数
+const maxDiscardBody = 64 << 10
+
+// isHTTPMethodByte 判断首字节是否可能是 HTTP 方法
+func isHTTPMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTP 处理 HTTP 代理请求：CONNECT 隧道和绝对 URI 的转发
+func (s *SOCKS5Server) handleHTTP(ctx context.Context, conn net.Conn, br *bufio.Reader, identity string) error {
+	for {
+		//等待下一个请求期间连接空闲，Shutdown 时可以直接关闭
+		if !s.setIdle(conn, true) {
+			return nil
+		}
+		_, err := br.Peek(1)
+		s.setIdle(conn, false)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return err
+		}
+		user, ok := s.httpAuth(req)
+		if user == "" {
+			user = identity
+		}
+		if !ok {
+			writeHTTPStatus(conn, http.StatusProxyAuthRequired, `Proxy-Authenticate: Basic realm="proxy"`)
+			//未读完的请求体会被当作下一个请求解析，无法丢弃时关闭连接
+			if req.Close || !discardBody(req.Body) {
+				return ErrPasswordAuthFailure
+			}
+			continue
+		}
+		if req.Method == http.MethodConnect {
+			return s.handleHTTPConnect(ctx, conn, req, user)
+		}
+		err = s.handleHTTPForward(ctx, conn, req, user)
+		if err != nil || req.Close {
+			return err
+		}
+	}
+}
+
+// discardBody 读完并关闭请求体，请求体超过 maxDiscardBody 或读取出错时返回 false
+func discardBody(body io.ReadCloser) bool {
+	defer body.Close()
+	_, err := io.CopyN(io.Discard, body, maxDiscardBody+1)
+	return err == io.EOF
+}
+
+// httpAuth 使用与 SOCKS5 相同的凭据校验 Proxy-Authorization，
+// 没有该头部时只在允许无认证时以匿名用户放行
+func (s *SOCKS5Server) httpAuth(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", s.acceptsNoAuth()
+	}
+	username, password, ok := parseProxyAuth(auth)
+	if !ok {
+		return "", false
+	}
+	for _, a := range s.authenticators() {
+		var store CredentialStore
+		switch a := a.(type) {
+		case UserPassAuthenticator:
+			store = a.Credentials
+		case *UserPassAuthenticator:
+			store = a.Credentials
+		}
+		if store != nil && store.Valid(username, password) {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+func parseProxyAuth(auth string) (string, string, bool) {
+	//借用 http.Request 解析 Basic 认证
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	return r.BasicAuth()
+}
+
+func (s *SOCKS5Server) handleHTTPConnect(ctx context.Context, conn net.Conn, req *http.Request, user string) error {
+	clientMessage, err := NewClientRequestMassageFromAddress(Connect, req.Host)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, "")
+		return err
+	}
+	reply := func(rep uint8, addr *AddrSpec) error {
+		if rep == successReply {
+			_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		}
+		return writeHTTPStatus(conn, httpStatus(rep), "")
+	}
+	return s.serveRequest(ctx, conn, clientMessage, user, reply)
+}
+
+func (s *SOCKS5Server) handleHTTPForward(ctx context.Context, conn net.Conn, req *http.Request, user string) error {
+	//拒绝请求时丢弃请求体以便继续使用连接
+	reject := func(code int) error {
+		if !discardBody(req.Body) {
+			req.Close = true
+		}
+		return writeHTTPStatus(conn, code, "")
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return reject(http.StatusBadRequest)
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	clientMessage, err := NewClientRequestMassageFromAddress(Connect, host)
+	if err != nil {
+		return reject(http.StatusBadRequest)
+	}
+	var rejected bool
+	reply := func(rep uint8, addr *AddrSpec) error {
+		//成功时由目标的响应作为应答
+		if rep == successReply {
+			return nil
+		}
+		rejected = true
+		return reject(httpStatus(rep))
+	}
+	relay := func(ctx context.Context, conn net.Conn, targetConn net.Conn, sess *session) error {
+		return s.forwardHTTPRequest(ctx, conn, targetConn, sess, req)
+	}
+	err = s.serveRequestRelay(ctx, conn, clientMessage, user, reply, relay)
+	if rejected {
+		//已向客户端返回错误状态，连接可以继续使用
+		return nil
+	}
+	return err
+}
+
+// forwardHTTPRequest 将请求转发给目标并把响应写回客户端
+func (s *SOCKS5Server) forwardHTTPRequest(ctx context.Context, conn net.Conn, targetConn net.Conn, sess *session, req *http.Request) error {
+	defer targetConn.Close()
+	//会话被结束时中断等待目标响应
+	stop := context.AfterFunc(ctx, func() { targetConn.Close() })
+	defer stop()
+
+	//转发给目标时使用 origin-form，并去掉逐跳头部
+	for _, h := range strings.Split(req.Header.Get("Connection"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			req.Header.Del(h)
+		}
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	up := s.throttled(ctx, countingWriter{targetConn, &s.metrics.tcpUp, &sess.in}, sess, clientToTarget)
+	if err := req.Write(up); err != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway, "")
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(targetConn), req)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway, "")
+		return err
+	}
+	defer resp.Body.Close()
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	//长度未知的响应只能以关闭连接结束
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		req.Close = true
+	}
+	resp.Close = req.Close
+	down := s.throttled(ctx, countingWriter{conn, &s.metrics.tcpDown, &sess.out}, sess, targetToClient)
+	return resp.Write(down)
+}
+
+// httpStatus 将应答码映射为 HTTP 状态码
+func httpStatus(rep uint8) int {
+	switch rep {
+	case ruleFailure:
+		return http.StatusForbidden
+	case networkUnreachable, hostUnreachable, connectionRefused:
+		return http.StatusBadGateway
+	case ttlExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func writeHTTPStatus(conn net.Conn, code int, header string) error {
+	if header != "" {
+		header += "\r\n"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\n\r\n", code, http.StatusText(code), header)
+	return err
+}
@@ -0,0 +1,329 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization forwarded to origin")
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{Credentials: StaticCredentials{"user": "pass"}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		url    string
+		proxy  *url.URL
+		status int
+		body   string
+	}{
+		{"Forward", backend.URL + "/a", &url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: addr}, http.StatusOK, "hello /a"},
+		{"Missing credentials", backend.URL + "/a", &url.URL{Scheme: "http", Host: addr}, http.StatusProxyAuthRequired, ""},
+		{"Wrong credentials", backend.URL + "/a", &url.URL{Scheme: "http", User: url.UserPassword("user", "bad"), Host: addr}, http.StatusProxyAuthRequired, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(tt.proxy)}}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("Get() = %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	transport := backend.Client().Transport.(*http.Transport)
+	transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: addr})
+	resp, err := (&http.Client{Transport: transport}).Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "secure" {
+		t.Errorf("body = %q, want secure", body)
+	}
+}
+
+func TestHTTPConnectRuleFailure(t *testing.T) {
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleDeny}}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT 127.0.0.1:9 HTTP/1.1\r\nHost: 127.0.0.1:9\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestHTTPAuthRequiredDiscardsBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{Credentials: StaticCredentials{"user": "pass"}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	//请求体不应被当作下一个请求
+	io.WriteString(conn, "POST "+backend.URL+"/a HTTP/1.1\r\nHost: x\r\nContent-Length: 18\r\n\r\nGET / HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+	io.WriteString(conn, "GET "+backend.URL+"/b HTTP/1.1\r\nHost: x\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello /b" {
+		t.Errorf("second request = %d %q, want 200 %q", resp.StatusCode, body, "hello /b")
+	}
+
+	//请求体过大时关闭连接
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	go func() {
+		io.WriteString(conn2, "POST "+backend.URL+"/a HTTP/1.1\r\nHost: x\r\nContent-Length: 1000000\r\n\r\n")
+		conn2.Write(make([]byte, 1000000))
+	}()
+	br2 := bufio.NewReader(conn2)
+	if resp, err := http.ReadResponse(br2, nil); err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("ReadResponse() = %v, %v", resp, err)
+	}
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br2.ReadByte(); err == nil || os.IsTimeout(err) {
+		t.Errorf("read after oversized body = %v, want connection closed", err)
+	}
+}
+
+func TestHTTPForwardAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	name := filepath.Join(t.TempDir(), "access.log")
+	s := &SOCKS5Server{AccessLog: &AccessLog{Filename: name}}
+	defer s.AccessLog.Close()
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	waitFor(t, func() bool { return s.activeConns() == 0 })
+
+	records := readAccessLog(t, name)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.Dest != backend.Listener.Addr().String() || r.Reply != int(successReply) ||
+		r.ResolvedIP != "127.0.0.1" || r.BytesIn == 0 || r.BytesOut == 0 {
+		t.Errorf("record = %+v", r)
+	}
+}
+
+func TestHTTPForwardAdminSessions(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	s := &SOCKS5Server{Credentials: StaticCredentials{"user": "pass"}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: addr})}}
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+
+	var sessions []SessionInfo
+	waitFor(t, func() bool {
+		adminRequest(t, s, http.MethodGet, "/sessions?user=user", &sessions)
+		return len(sessions) == 1
+	})
+	if sessions[0].Dest != backend.Listener.Addr().String() {
+		t.Errorf("session = %+v", sessions[0])
+	}
+	if code := adminRequest(t, s, http.MethodDelete, "/sessions/"+strconv.FormatUint(sessions[0].ID, 10), nil); code != http.StatusOK {
+		t.Fatalf("DELETE /sessions/%d = %v", sessions[0].ID, code)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("killed request succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request not ended after kill")
+	}
+	waitFor(t, func() bool { return len(s.Sessions()) == 0 })
+}
+
+func TestHTTPForwardThrottle(t *testing.T) {
+	body := strings.Repeat("x", 150000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{Throttle: &Throttle{}}
+	s.Throttle.SetGlobal(Bandwidth{Down: 100000})
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+	start := time.Now()
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(got) != len(body) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(body))
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("150000 bytes at 100000 B/s took %v, want about 500ms", d)
+	}
+}
+
+func TestHTTPAuthWithNoAuthAllowed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{
+		Authenticators: []Authenticator{
+			UserPassAuthenticator{Credentials: StaticCredentials{"alice": "a"}},
+			NoAuthAuthenticator{},
+		},
+		Rules: Rules{{Action: RuleAllow, Users: []string{"alice"}}},
+	}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		user   *url.Userinfo
+		status int
+	}{
+		//携带凭据时按认证用户匹配规则，不能当作匿名用户
+		{"Valid credentials", url.UserPassword("alice", "a"), http.StatusOK},
+		{"Wrong credentials", url.UserPassword("alice", "bad"), http.StatusProxyAuthRequired},
+		{"Anonymous", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: tt.user, Host: addr})}}
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestShutdownIdleHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	s := &SOCKS5Server{}
+	addr, serveErr := startServer(t, s)
+
+	transport := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if n := s.activeConns(); n != 1 {
+		t.Fatalf("active connections = %d, want the idle keep-alive connection", n)
+	}
+
+	//空闲的 keep-alive 连接不应让 Shutdown 等到超时
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown() took %v with only an idle connection", d)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve() error = %v, want %v", err, ErrServerClosed)
+	}
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// logger 返回服务端配置的日志记录器，未配置时使用 slog.Default()
+func (s *SOCKS5Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// log 返回 ctx 所属连接的日志记录器，已带有连接编号、客户端地址等字段
+func (s *SOCKS5Server) log(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return s.logger()
+}
+
+// withLogAttrs 返回在连接日志记录器上追加 args 字段后的 ctx
+func (s *SOCKS5Server) withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, s.log(ctx).With(args...))
+}
+
+// handshakeFailed 记录握手失败
+func (s *SOCKS5Server) handshakeFailed(ctx context.Context, err error) {
+	s.metrics.handshakeFailed(err)
+	s.log(ctx).Info("handshake failed", "err", err)
+}
+
+func commandName(cmd Command) string {
+	switch cmd {
+	case Connect:
+		return "connect"
+	case Bind:
+		return "bind"
+	case UDPAssociate:
+		return "udp_associate"
+	}
+	return "unknown"
+}
@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer 供多个连接的 goroutine 并发写日志
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r map[string]any
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("unmarshal %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestConnectionLogging(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	out := &lockedBuffer{}
+	s := &SOCKS5Server{Logger: slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+		echoRoundTrip(t, conn)
+		conn.Close()
+	}
+	waitFor(t, func() bool { return s.activeConns() == 0 })
+
+	ids := make(map[float64]bool)
+	var requests int
+	for _, r := range out.records(t) {
+		id, ok := r["conn"].(float64)
+		if !ok || r["client"] == nil {
+			t.Errorf("record %v has no conn or client", r)
+		}
+		ids[id] = true
+		if r["msg"] == "request" {
+			requests++
+			if r["cmd"] != "connect" || r["dest"] != echo.Addr().String() {
+				t.Errorf("request record = %v, want cmd connect and dest %v", r, echo.Addr())
+			}
+		}
+	}
+	if len(ids) != 2 || requests != 2 {
+		t.Errorf("got %d connection ids and %d requests, want 2 and 2", len(ids), requests)
+	}
+}
+
+func TestLoggingLevel(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	out := &lockedBuffer{}
+	s := &SOCKS5Server{Logger: slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelInfo}))}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	echoRoundTrip(t, conn)
+	conn.Close()
+	waitFor(t, func() bool { return s.activeConns() == 0 })
+	if records := out.records(t); len(records) != 0 {
+		t.Errorf("Info level logged a successful request: %v", records)
+	}
+}
+
+func TestSOCKS4UserIDLogging(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	out := &lockedBuffer{}
+	s := &SOCKS5Server{Logger: slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	port := echo.Addr().(*net.TCPAddr).Port
+	conn, reply := socks4Connect(t, addr, []byte{SOCKS4Version, Connect, byte(port >> 8), byte(port), 127, 0, 0, 1, 'b', 'o', 'b', 0})
+	if reply[1] != socks4Granted {
+		t.Fatalf("reply = %v, want granted", reply)
+	}
+	echoRoundTrip(t, conn)
+	conn.Close()
+	waitFor(t, func() bool { return s.activeConns() == 0 })
+
+	var found bool
+	for _, r := range out.records(t) {
+		if r["msg"] == "request" {
+			found = true
+			if r["socks4_userid"] != "bob" || r["user"] != nil {
+				t.Errorf("request record = %v, want socks4_userid bob and no user", r)
+			}
+		}
+	}
+	if !found {
+		t.Error("no request record")
+	}
+}
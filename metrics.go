@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 拨号耗时直方图的桶上界，单位为秒
+var dialBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 握手失败的错误类别，用作指标标签
+var handshakeErrors = []struct {
+	err  error
+	name string
+}{
+	{ErrVersion, "version"},
+	{ErrInvalidMethod, "invalid_method"},
+	{ErrNoAcceptableMethod, "no_acceptable_method"},
+	{ErrPasswordVersion, "password_version"},
+	{ErrPasswordAuthFailure, "auth_failure"},
+	{ErrInvaildReservedField, "reserved_field"},
+	{ErrInvalidAddressType, "address_type"},
+	{ErrInvalidPort, "port"},
+	{ErrUnsupportedCommand, "unsupported_command"},
+	{ErrSOCKS4AuthRequired, "socks4_auth_required"},
+	{ErrSOCKS4FieldTooLong, "socks4_field_too_long"},
+	{ErrProxyProtoHeader, "proxy_protocol"},
+	{io.EOF, "eof"},
+	{io.ErrUnexpectedEOF, "eof"},
+	{os.ErrDeadlineExceeded, "timeout"},
+}
+
+func handshakeErrorName(err error) string {
+	for _, e := range handshakeErrors {
+		if errors.Is(err, e.err) {
+			return e.name
+		}
+	}
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) {
+		return "tls"
+	}
+	return "other"
+}
+
+// metrics 记录服务端的运行指标，零值可用
+type metrics struct {
+	connections    atomic.Uint64
+	replies        [256]atomic.Uint64
+	tcpUp, tcpDown atomic.Uint64
+	udpUp, udpDown atomic.Uint64
+	tunnels        atomic.Int64
+	associations   atomic.Int64
+
+	mu                sync.Mutex
+	handshakeFailures map[string]uint64
+	// 各个桶内（非累计）的拨号次数，最后一个为 +Inf
+	dialCounts [len(dialBuckets) + 1]uint64
+	dialSum    float64
+}
+
+func (m *metrics) handshakeFailed(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handshakeFailures == nil {
+		m.handshakeFailures = make(map[string]uint64)
+	}
+	m.handshakeFailures[handshakeErrorName(err)]++
+}
+
+func (m *metrics) observeDial(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(dialBuckets[:], v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialCounts[i]++
+	m.dialSum += v
+}
+
+// countReplies 包装 reply，按应答码计数
+func (m *metrics) countReplies(reply replyFunc) replyFunc {
+	return func(rep uint8, addr *AddrSpec) error {
+		m.replies[rep].Add(1)
+		return reply(rep, addr)
+	}
+}
+
+// countingWriter 将写入的字节数同时累加到总计数和会话计数
+type countingWriter struct {
+	w       io.Writer
+	total   *atomic.Uint64
+	session *atomic.Uint64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.total.Add(uint64(n))
+	c.session.Add(uint64(n))
+	return n, err
+}
+
+// writeTo 以 Prometheus 文本格式输出全部指标
+func (m *metrics) writeTo(w io.Writer) error {
+	m.mu.Lock()
+	failures := make([]string, 0, len(m.handshakeFailures))
+	for name := range m.handshakeFailures {
+		failures = append(failures, name)
+	}
+	sort.Strings(failures)
+	failureCounts := make([]uint64, len(failures))
+	for i, name := range failures {
+		failureCounts[i] = m.handshakeFailures[name]
+	}
+	dialCounts := m.dialCounts
+	dialSum := m.dialSum
+	m.mu.Unlock()
+
+	var b []byte
+	header := func(name, typ, help string) {
+		b = fmt.Appendf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	header("socks5_connections_total", "counter", "Accepted client connections.")
+	b = fmt.Appendf(b, "socks5_connections_total %d\n", m.connections.Load())
+
+	header("socks5_handshake_failures_total", "counter", "Failed client handshakes by error.")
+	for i, name := range failures {
+		b = fmt.Appendf(b, "socks5_handshake_failures_total{error=%q} %d\n", name, failureCounts[i])
+	}
+
+	header("socks5_replies_total", "counter", "Replies sent to clients by reply code.")
+	for code := range m.replies {
+		if n := m.replies[code].Load(); n > 0 {
+			b = fmt.Appendf(b, "socks5_replies_total{code=\"%d\"} %d\n", code, n)
+		}
+	}
+
+	header("socks5_dial_duration_seconds", "histogram", "Time spent connecting to targets.")
+	var cumulative uint64
+	for i, le := range dialBuckets {
+		cumulative += dialCounts[i]
+		b = fmt.Appendf(b, "socks5_dial_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	cumulative += dialCounts[len(dialBuckets)]
+	b = fmt.Appendf(b, "socks5_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	b = fmt.Appendf(b, "socks5_dial_duration_seconds_sum %s\n", strconv.FormatFloat(dialSum, 'g', -1, 64))
+	b = fmt.Appendf(b, "socks5_dial_duration_seconds_count %d\n", cumulative)
+
+	header("socks5_relayed_bytes_total", "counter", "Bytes relayed between clients and targets.")
+	b = fmt.Appendf(b, "socks5_relayed_bytes_total{proto=\"tcp\",direction=\"client_to_target\"} %d\n", m.tcpUp.Load())
+	b = fmt.Appendf(b, "socks5_relayed_bytes_total{proto=\"tcp\",direction=\"target_to_client\"} %d\n", m.tcpDown.Load())
+	b = fmt.Appendf(b, "socks5_relayed_bytes_total{proto=\"udp\",direction=\"client_to_target\"} %d\n", m.udpUp.Load())
+	b = fmt.Appendf(b, "socks5_relayed_bytes_total{proto=\"udp\",direction=\"target_to_client\"} %d\n", m.udpDown.Load())
+
+	header("socks5_active_tunnels", "gauge", "TCP tunnels currently relaying.")
+	b = fmt.Appendf(b, "socks5_active_tunnels %d\n", m.tunnels.Load())
+
+	header("socks5_active_udp_associations", "gauge", "UDP associations currently open.")
+	b = fmt.Appendf(b, "socks5_active_udp_associations %d\n", m.associations.Load())
+
+	_, err := w.Write(b)
+	return err
+}
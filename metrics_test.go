@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	echoRoundTrip(t, conn)
+
+	bad, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write([]byte{SOCKS5Version, 1, UserPassword})
+	io.ReadAll(bad)
+	bad.Close()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	//写回客户端的字节在客户端读到后才计入
+	var body string
+	waitFor(t, func() bool {
+		body = scrape()
+		return strings.Contains(body, `direction="target_to_client"} 4`)
+	})
+	for _, want := range []string{
+		"socks5_connections_total 2\n",
+		`socks5_handshake_failures_total{error="no_acceptable_method"} 1` + "\n",
+		`socks5_replies_total{code="0"} 1` + "\n",
+		`socks5_dial_duration_seconds_count 1` + "\n",
+		`socks5_relayed_bytes_total{proto="tcp",direction="client_to_target"} 4` + "\n",
+		`socks5_relayed_bytes_total{proto="tcp",direction="target_to_client"} 4` + "\n",
+		"socks5_active_tunnels 1\n",
+		"# TYPE socks5_dial_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q\n%s", want, body)
+		}
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return strings.Contains(scrape(), "socks5_active_tunnels 0\n") })
+}
+
+// waitFor 等待 cond 成立，最多一秒
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsUDPAssociation(t *testing.T) {
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	c := &Client{ProxyAddr: addr}
+	pc, err := c.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.metrics.associations.Load() == 1 })
+	pc.Close()
+	waitFor(t, func() bool { return s.metrics.associations.Load() == 0 })
+}
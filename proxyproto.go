@@ -0,0 +1,238 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY 协议 v2 签名
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// v1 头部最大长度
+	proxyProtoV1MaxLen = 107
+	// 读取 PROXY 协议头的超时时间
+	proxyProtoTimeout = 10 * time.Second
+)
+
+var (
+	ErrProxyProtoHeader  = errors.New("invalid PROXY protocol header")
+	ErrProxyProtoVersion = errors.New("unsupported PROXY protocol version")
+)
+
+// ReadProxyHeader 读取 PROXY 协议 v1 或 v2 头部，返回源地址和目的地址。
+// 头部为 UNKNOWN 或 LOCAL 时返回 nil 地址
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	prefix, err := r.Peek(6)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := head[12], head[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	//LOCAL 命令表示负载均衡器自身的连接
+	if verCmd&0x0f == 0 {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrProxyProtoHeader
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if family&0x0f == 2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// proxyProtoListener 对来自可信网段的连接解析 PROXY 协议头
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !matchNetwork(l.trusted, addrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn 在第一次读取时解析头部，RemoteAddr 返回头部中的源地址
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+		c.remote, _, c.err = ReadProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// WriteProxyHeader 向 w 写入 version 版本（1 或 2）的 PROXY 协议头。
+// src 或 dst 不是 TCP/UDP 地址时，v1 写入 UNKNOWN，v2 写入 LOCAL 命令
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcIP, dstIP := addrIP(src), addrIP(dst)
+	var srcPort, dstPort int
+	if srcIP != nil && dstIP != nil {
+		srcPort, dstPort = addrPort(src), addrPort(dst)
+		//两端地址族不同时统一使用 IPv6 形式
+		if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+			srcIP, dstIP = src4, dst4
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+	}
+	switch version {
+	case 1:
+		return writeProxyHeaderV1(w, srcIP, dstIP, srcPort, dstPort)
+	case 2:
+		return writeProxyHeaderV2(w, srcIP, dstIP, srcPort, dstPort)
+	}
+	return ErrProxyProtoVersion
+}
+
+func writeProxyHeaderV1(w io.Writer, srcIP, dstIP net.IP, srcPort, dstPort int) error {
+	if srcIP == nil || dstIP == nil {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	if len(srcIP) == net.IPv4len {
+		_, err := fmt.Fprintf(w, "PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, srcPort, dstPort)
+		return err
+	}
+	//TCP6 中的 IPv4 映射地址也要写成 IPv6 形式
+	src, dst := netip.AddrFrom16([16]byte(srcIP)), netip.AddrFrom16([16]byte(dstIP))
+	_, err := fmt.Fprintf(w, "PROXY TCP6 %s %s %d %d\r\n", src, dst, srcPort, dstPort)
+	return err
+}
+
+func writeProxyHeaderV2(w io.Writer, srcIP, dstIP net.IP, srcPort, dstPort int) error {
+	buf := append([]byte{}, proxyProtoV2Sig...)
+	if srcIP == nil || dstIP == nil {
+		buf = append(buf, 0x20, 0x00, 0, 0)
+		_, err := w.Write(buf)
+		return err
+	}
+	//地址族：0x11 为 TCP over IPv4，0x21 为 TCP over IPv6
+	family := byte(0x11)
+	if len(srcIP) == net.IPv6len {
+		family = 0x21
+	}
+	buf = append(buf, 0x21, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(2*len(srcIP)+4))
+	buf = append(buf, srcIP...)
+	buf = append(buf, dstIP...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(srcPort))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(dstPort))
+	_, err := w.Write(buf)
+	return err
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
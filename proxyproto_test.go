@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyProtoV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0x04, 0x38)
+	v2Local := append([]byte{}, proxyProtoV2Sig...)
+	v2Local = append(v2Local, 0x20, 0x00, 0, 0)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		wantErr bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 1080\r\n"), "203.0.113.7:12345", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 1080\r\n"), "[2001:db8::1]:12345", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 malformed", []byte("PROXY TCP4 203.0.113.7\r\n"), "", true},
+		{"v2 TCP4", v2, "203.0.113.7:12345", false},
+		{"v2 LOCAL", v2Local, "", false},
+		{"Not PROXY", []byte{SOCKS5Version, 1, NoAuth, 0, 0, 0}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.input, "rest"...)))
+			src, _, err := ReadProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := ""; src != nil {
+				got = src.String()
+				if got != tt.want {
+					t.Errorf("ReadProxyHeader() = %v, want %v", got, tt.want)
+				}
+			} else if tt.want != "" {
+				t.Errorf("ReadProxyHeader() = nil, want %v", tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+				t.Errorf("remaining data = %q, want rest", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolClientAddr(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{
+		ProxyProtocolTrusted: []*net.IPNet{mustCIDR("127.0.0.0/8")},
+		Rules:                Rules{{Action: RuleAllow, Sources: []*net.IPNet{mustCIDR("203.0.113.0/24")}}},
+	}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+	target := echo.Addr().(*net.TCPAddr)
+
+	for _, tt := range []struct {
+		header string
+		want   byte
+	}{
+		{"PROXY TCP4 203.0.113.7 127.0.0.1 40000 1080\r\n", successReply},
+		{"PROXY TCP4 198.51.100.7 127.0.0.1 40000 1080\r\n", ruleFailure},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := []byte{SOCKS5Version, Connect, 0x00, IPv4}
+		req = append(req, target.IP.To4()...)
+		req = append(req, byte(target.Port>>8), byte(target.Port))
+		conn.Write([]byte(tt.header))
+		conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+		conn.Write(req)
+		io.ReadFull(conn, make([]byte, 2))
+		if rep, _ := readReply(t, conn); rep != tt.want {
+			t.Errorf("%q: reply = %v, want %v", tt.header, rep, tt.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolUntrustedSource(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{ProxyProtocolTrusted: []*net.IPNet{mustCIDR("10.0.0.0/8")}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	defer conn.Close()
+	echoRoundTrip(t, conn)
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+		want    string
+	}{
+		{"v1 TCP4", 1, &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, "203.0.113.7:40000"},
+		{"v1 mixed", 1, &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, "203.0.113.7:40000"},
+		{"v1 unknown", 1, nil, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, ""},
+		{"v2 TCP6", 2, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, "[2001:db8::7]:40000"},
+		{"v2 local", 2, nil, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatalf("WriteProxyHeader() error = %v", err)
+			}
+			if tt.name == "v1 mixed" && !bytes.HasPrefix(buf.Bytes(), []byte("PROXY TCP6 ::ffff:203.0.113.7 2001:db8::1 ")) {
+				t.Errorf("header = %q, want IPv6 form", buf.Bytes())
+			}
+			src, _, err := ReadProxyHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("ReadProxyHeader() error = %v", err)
+			}
+			got := ""
+			if src != nil {
+				got = src.String()
+			}
+			if got != tt.want {
+				t.Errorf("source = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := WriteProxyHeader(io.Discard, 3, nil, nil); err != ErrProxyProtoVersion {
+		t.Errorf("WriteProxyHeader() error = %v, want %v", err, ErrProxyProtoVersion)
+	}
+}
+
+func TestProxyProtocolToTarget(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	srcCh := make(chan net.Addr, 1)
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		src, _, err := ReadProxyHeader(r)
+		if err != nil {
+			srcCh <- nil
+			return
+		}
+		srcCh <- src
+		io.Copy(c, r)
+	}()
+
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleAllow, ProxyProtocol: 2}}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, target.Addr().(*net.TCPAddr))
+	defer conn.Close()
+	src := <-srcCh
+	if src == nil || src.String() != conn.LocalAddr().String() {
+		t.Fatalf("PROXY source = %v, want %v", src, conn.LocalAddr())
+	}
+	echoRoundTrip(t, conn)
+}
@@ -1,152 +1,277 @@
-package socks5
-
-import (
-	"encoding/binary"
-	"fmt"
-	"io"
-	"net"
-)
-
-type AddrSpec struct {
-	IP   net.IP
-	FQDN string
-	Port int
-}
-
-const (
-	IPV4Len = 4
-	IPV6Len = 16
-)
-
-type ClientRequestMassage struct {
-	Cmd      Command
-	AddrType AddressType
-	Address  string
-	Port     uint16
-}
-
-type Command = byte
-
-const (
-	Connect      Command = 0x01
-	Bind         Command = 0x02
-	UDPAssociate Command = 0x03
-)
-
-type AddressType = byte
-
-const (
-	IPv4       AddressType = 0x01
-	DomainName AddressType = 0x03
-	IPv6       AddressType = 0x04
-)
-
-const (
-	successReply uint8 = iota
-	serverFailure
-	ruleFailure
-	networkUnreachable
-	hostUnreachable
-	connectionRefused
-	ttlExpired
-	commandNotSupported
-	addrTypeNotSupported
-)
-
-func NewClientRequestMassage(conn net.Conn) (*ClientRequestMassage, error) {
-	buf := make([]byte, 4)
-	_, err := io.ReadFull(conn, buf)
-	if err != nil {
-		return nil, err
-	}
-	//检查
-	version, command, reserved, addrType := buf[0], buf[1], buf[2], buf[3]
-	if version != SOCKS5Version {
-		return nil, ErrVersion
-	}
-	if command != Connect && command != Bind && command != UDPAssociate {
-		return nil, ErrUnsupportedCommand
-	}
-	if reserved != ReservedFeild {
-		return nil, ErrInvaildReservedField
-	}
-	if addrType != IPv4 && addrType != DomainName && addrType != IPv6 {
-		return nil, ErrInvalidAddressType
-	}
-	//读取地址和端口
-	var address string
-	switch addrType {
-	case IPv4:
-		buf = make([]byte, IPV4Len)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return nil, err
-		}
-		address = net.IP(buf[0:4]).String()
-	case DomainName:
-		buf = make([]byte, 1)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return nil, err
-		}
-		buf = make([]byte, buf[0])
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return nil, err
-		}
-		address = string(buf)
-	case IPv6:
-		buf = make([]byte, IPV6Len)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return nil, err
-		}
-		address = net.IP(buf[0:16]).String()
-	}
-	buf = make([]byte, 2)
-	_, err = io.ReadFull(conn, buf)
-	if err != nil {
-		return nil, err
-	}
-	port := binary.BigEndian.Uint16(buf[len(buf)-2:])
-	//if port == 0 {
-	//	return nil, ErrInvalidPort
-	//}
-	fmt.Printf("address: %s, port: %d\n", address, port)
-	return &ClientRequestMassage{
-		Cmd:     command,
-		Address: address,
-		Port:    port,
-	}, nil
-}
-
-func SendReply(conn net.Conn, rep uint8, addr *AddrSpec) error {
-	reply := []byte{SOCKS5Version, rep, ReservedFeild}
-	if addr == nil {
-		addr = &AddrSpec{}
-	}
-	switch {
-	case addr.IP.To4() != nil:
-		// IPv4 地址
-		reply = append(reply, IPv4)
-		reply = append(reply, addr.IP.To4()...)
-	case addr.FQDN != "":
-		// 域名地址
-		reply = append(reply, DomainName)
-		reply = append(reply, byte(len(addr.FQDN)))
-		reply = append(reply, []byte(addr.FQDN)...)
-	case addr.IP.To16() != nil:
-		// IPv6 地址
-		reply = append(reply, IPv6)
-		reply = append(reply, addr.IP.To16()...)
-	case addr.IP == nil:
-		// 无地址
-		reply = append(reply, IPv4)
-		reply = append(reply, []byte{0, 0, 0, 0}...)
-	}
-	port := make([]byte, 2)
-	binary.BigEndian.PutUint16(port, uint16(addr.Port))
-	reply = append(reply, port...)
-	_, err := conn.Write(reply)
-	return err
-}
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+type AddrSpec struct {
+	IP   net.IP
+	FQDN string
+	Port int
+}
+
+func (a *AddrSpec) String() string {
+	host := a.FQDN
+	if a.IP != nil {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+const (
+	IPV4Len = 4
+	IPV6Len = 16
+)
+
+type ClientRequestMassage struct {
+	Cmd      Command
+	AddrType AddressType
+	Address  string
+	Port     uint16
+}
+
+type Command = byte
+
+const (
+	Connect      Command = 0x01
+	Bind         Command = 0x02
+	UDPAssociate Command = 0x03
+)
+
+type AddressType = byte
+
+const (
+	IPv4       AddressType = 0x01
+	DomainName AddressType = 0x03
+	IPv6       AddressType = 0x04
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+func NewClientRequestMassage(conn net.Conn) (*ClientRequestMassage, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	//检查
+	version, command, reserved, addrType := buf[0], buf[1], buf[2], buf[3]
+	if version != SOCKS5Version {
+		return nil, ErrVersion
+	}
+	if command != Connect && command != Bind && command != UDPAssociate {
+		return nil, ErrUnsupportedCommand
+	}
+	if reserved != ReservedFeild {
+		return nil, ErrInvaildReservedField
+	}
+	if addrType != IPv4 && addrType != DomainName && addrType != IPv6 {
+		return nil, ErrInvalidAddressType
+	}
+	//读取地址和端口
+	var address string
+	switch addrType {
+	case IPv4:
+		buf = make([]byte, IPV4Len)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		address = net.IP(buf[0:4]).String()
+	case DomainName:
+		buf = make([]byte, 1)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = make([]byte, buf[0])
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		address = string(buf)
+	case IPv6:
+		buf = make([]byte, IPV6Len)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return nil, err
+		}
+		address = net.IP(buf[0:16]).String()
+	}
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[len(buf)-2:])
+	//if port == 0 {
+	//	return nil, ErrInvalidPort
+	//}
+	return &ClientRequestMassage{
+		Cmd:      command,
+		AddrType: addrType,
+		Address:  address,
+		Port:     port,
+	}, nil
+}
+
+func SendReply(conn net.Conn, rep uint8, addr *AddrSpec) error {
+	reply := []byte{SOCKS5Version, rep, ReservedFeild}
+	if addr == nil {
+		addr = &AddrSpec{}
+	}
+	switch {
+	case addr.IP.To4() != nil:
+		// IPv4 地址
+		reply = append(reply, IPv4)
+		reply = append(reply, addr.IP.To4()...)
+	case addr.FQDN != "":
+		// 域名地址
+		reply = append(reply, DomainName)
+		reply = append(reply, byte(len(addr.FQDN)))
+		reply = append(reply, []byte(addr.FQDN)...)
+	case addr.IP.To16() != nil:
+		// IPv6 地址
+		reply = append(reply, IPv6)
+		reply = append(reply, addr.IP.To16()...)
+	case addr.IP == nil:
+		// 无地址
+		reply = append(reply, IPv4)
+		reply = append(reply, []byte{0, 0, 0, 0}...)
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(addr.Port))
+	reply = append(reply, port...)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// ReplyError 表示非成功的应答，Err 为导致该应答的原因
+type ReplyError struct {
+	Code uint8
+	Err  error
+}
+
+var replyMessages = []string{
+	successReply:         "succeeded",
+	serverFailure:        "general SOCKS server failure",
+	ruleFailure:          "connection not allowed by ruleset",
+	networkUnreachable:   "network unreachable",
+	hostUnreachable:      "host unreachable",
+	connectionRefused:    "connection refused",
+	ttlExpired:           "TTL expired",
+	commandNotSupported:  "command not supported",
+	addrTypeNotSupported: "address type not supported",
+}
+
+func (e *ReplyError) Error() string {
+	msg := fmt.Sprintf("unknown reply code %d", e.Code)
+	if int(e.Code) < len(replyMessages) {
+		msg = replyMessages[e.Code]
+	}
+	if e.Err != nil {
+		return "socks5: " + msg + ": " + e.Err.Error()
+	}
+	return "socks5: " + msg
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// NewClientRequestMassageFromAddress 根据 host:port 构造请求，自动判断地址类型
+func NewClientRequestMassageFromAddress(cmd Command, address string) (*ClientRequestMassage, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidPort
+	}
+	addrType := DomainName
+	if ip := net.ParseIP(host); ip != nil {
+		addrType = IPv6
+		if ip.To4() != nil {
+			addrType = IPv4
+		}
+	} else if len(host) > 255 {
+		return nil, ErrInvalidAddressType
+	}
+	return &ClientRequestMassage{
+		Cmd:      cmd,
+		AddrType: addrType,
+		Address:  host,
+		Port:     uint16(portNum),
+	}, nil
+}
+
+func (m *ClientRequestMassage) Send(conn net.Conn) error {
+	addr, err := NewAddrByteFromString(net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port))))
+	if err != nil {
+		return err
+	}
+	buf := []byte{SOCKS5Version, m.Cmd, ReservedFeild}
+	buf = append(buf, addr...)
+	_, err = conn.Write(buf)
+	return err
+}
+
+// ReadReply 读取服务端应答，与 SendReply 对应
+func ReadReply(conn net.Conn) (uint8, *AddrSpec, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != SOCKS5Version {
+		return 0, nil, ErrVersion
+	}
+	rep, addrType := buf[1], buf[3]
+	addr := &AddrSpec{}
+	switch addrType {
+	case IPv4:
+		buf = make([]byte, IPV4Len)
+		_, err = io.ReadFull(conn, buf)
+		addr.IP = net.IP(buf)
+	case IPv6:
+		buf = make([]byte, IPV6Len)
+		_, err = io.ReadFull(conn, buf)
+		addr.IP = net.IP(buf)
+	case DomainName:
+		buf = make([]byte, 1)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		buf = make([]byte, buf[0])
+		_, err = io.ReadFull(conn, buf)
+		addr.FQDN = string(buf)
+	default:
+		return 0, nil, ErrInvalidAddressType
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	buf = make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(buf))
+	return rep, addr, nil
+}
@@ -1,134 +1,341 @@
-package socks5
-
-import (
-	"bytes"
-	"errors"
-	"net"
-	"testing"
-)
-
-func TestNewClientRequestMassage(t *testing.T) {
-	tests := []struct {
-		name    string
-		input   []byte
-		wantErr bool
-	}{
-		{
-			name:    "Valid IPv4 Connect",
-			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: false,
-		},
-		{
-			name:    "Invalid Version",
-			input:   []byte{0x04, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: true,
-		},
-		{
-			name:    "Unsupported Command",
-			input:   []byte{0x05, 0x04, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: true,
-		},
-		{
-			name:    "Invalid Reserved Field",
-			input:   []byte{0x05, 0x01, 0x01, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: true,
-		},
-		{
-			name:    "Invalid Address Type",
-			input:   []byte{0x05, 0x01, 0x00, 0x05, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: true,
-		},
-		{
-			name:    "Valid Domain Name",
-			input:   []byte{0x05, 0x01, 0x00, 0x03, 0x0B, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x1F, 0x90},
-			wantErr: false,
-		},
-		{
-			name:    "Valid IPv6",
-			input:   []byte{0x05, 0x01, 0x00, 0x04, 0x20, 0x01, 0x0D, 0xB8, 0x85, 0xA3, 0x00, 0x00, 0x00, 0x00, 0x8A, 0x2E, 0x03, 0x70, 0x73, 0x34, 0x1F, 0x90},
-			wantErr: false,
-		},
-		{
-			name:    "Valid Port",
-			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
-			wantErr: false,
-		},
-		{
-			name:    "Invalid Port",
-			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F},
-			wantErr: true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			conn := &mockConn{buf: bytes.NewBuffer(tt.input)}
-			_, err := NewClientRequestMassage(conn)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("NewClientRequestMassage() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
-
-var netDial func(network, address string) (net.Conn, error)
-
-func TestRequest(t *testing.T) {
-    tests := []struct {
-        name       string
-        clientMsg  []byte
-        wantReply  []byte
-        wantErr    bool
-        dialErr    error
-    }{
-        {
-            name: "Command not supported",
-            clientMsg: []byte{SOCKS5Version, Bind, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
-            wantReply: []byte{SOCKS5Version, commandNotSupported, 0x00, IPv4, 0, 0, 0, 0, 0, 0},
-            wantErr:   true,
-        },
-        {
-            name: "Address type not supported",
-            clientMsg: []byte{SOCKS5Version, Bind, 0x00, IPv6, 0x20, 0x01, 0x0D, 0xB8, 0x85, 0xA3, 0x00, 0x00, 0x00, 0x00, 0x8A, 0x2E, 0x03, 0x70, 0x73, 0x34, 0x1F, 0x90},
-            wantReply: []byte{SOCKS5Version, addrTypeNotSupported, 0x00, IPv4, 0, 0, 0, 0, 0, 0},
-            wantErr:   true,
-        },
-        {
-            name: "Host unreachable",
-            clientMsg: []byte{SOCKS5Version, Bind, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
-            wantReply: []byte{SOCKS5Version, hostUnreachable, 0x00, IPv4, 0, 0, 0, 0, 0, 0},
-            wantErr:   true,
-            dialErr:   &net.OpError{Op: "dial", Err: errors.New("host unreachable")},
-        },
-        {
-            name: "Success",
-            clientMsg: []byte{SOCKS5Version, Bind, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
-            wantReply: []byte{SOCKS5Version, successReply, 0x00, IPv4, 127, 0, 0, 1, 0x04, 0x38},
-            wantErr:   false,
-        },
-    }
-
-    for _, tt := range tests {
-        t.Run(tt.name, func(t *testing.T) {
-            conn := &mockConn{buf: bytes.NewBuffer(tt.clientMsg)}
-            dialer := func(network, address string) (net.Conn, error) {
-                if tt.dialErr != nil {
-                    return nil, tt.dialErr
-                }
-                return &mockConn{buf: new(bytes.Buffer)}, nil
-            }
-
-            // Replace net.Dial with our mock dialer
-            netDial = dialer
-
-            err := request(conn)
-            if (err != nil) != tt.wantErr {
-                t.Errorf("request() error = %v, wantErr %v", err, tt.wantErr)
-                return
-            }
-            if got := conn.buf.Bytes(); !bytes.Equal(got, tt.wantReply) {
-                t.Errorf("request() = %v, want %v", got, tt.wantReply)
-            }
-        })
-    }
-}
\ No newline at end of file
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewClientRequestMassage(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+	}{
+		{
+			name:    "Valid IPv4 Connect",
+			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: false,
+		},
+		{
+			name:    "Invalid Version",
+			input:   []byte{0x04, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: true,
+		},
+		{
+			name:    "Unsupported Command",
+			input:   []byte{0x05, 0x04, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid Reserved Field",
+			input:   []byte{0x05, 0x01, 0x01, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid Address Type",
+			input:   []byte{0x05, 0x01, 0x00, 0x05, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: true,
+		},
+		{
+			name:    "Valid Domain Name",
+			input:   []byte{0x05, 0x01, 0x00, 0x03, 0x0B, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x1F, 0x90},
+			wantErr: false,
+		},
+		{
+			name:    "Valid IPv6",
+			input:   []byte{0x05, 0x01, 0x00, 0x04, 0x20, 0x01, 0x0D, 0xB8, 0x85, 0xA3, 0x00, 0x00, 0x00, 0x00, 0x8A, 0x2E, 0x03, 0x70, 0x73, 0x34, 0x1F, 0x90},
+			wantErr: false,
+		},
+		{
+			name:    "Valid Port",
+			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F, 0x90},
+			wantErr: false,
+		},
+		{
+			name:    "Invalid Port",
+			input:   []byte{0x05, 0x01, 0x00, 0x01, 192, 168, 0, 1, 0x1F},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConn{buf: bytes.NewBuffer(tt.input)}
+			_, err := NewClientRequestMassage(conn)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewClientRequestMassage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequest(t *testing.T) {
+    tests := []struct {
+        name       string
+        clientMsg  []byte
+        wantReply  []byte
+        wantErr    bool
+        dialErr    error
+    }{
+        {
+            name: "Host unreachable",
+            clientMsg: []byte{SOCKS5Version, Connect, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
+            wantReply: []byte{SOCKS5Version, hostUnreachable, 0x00, IPv4, 0, 0, 0, 0, 0, 0},
+            wantErr:   true,
+            dialErr:   &net.OpError{Op: "dial", Err: errors.New("host unreachable")},
+        },
+        {
+            name: "Connection refused",
+            clientMsg: []byte{SOCKS5Version, Connect, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
+            wantReply: []byte{SOCKS5Version, connectionRefused, 0x00, IPv4, 0, 0, 0, 0, 0, 0},
+            wantErr:   true,
+            dialErr:   &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+        },
+        {
+            name: "Success",
+            clientMsg: []byte{SOCKS5Version, Connect, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90},
+            wantReply: []byte{SOCKS5Version, successReply, 0x00, IPv4, 127, 0, 0, 1, 0x04, 0x38},
+            wantErr:   false,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            conn := &mockConn{buf: bytes.NewBuffer(tt.clientMsg), out: new(bytes.Buffer)}
+            dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+                if tt.dialErr != nil {
+                    return nil, tt.dialErr
+                }
+                return &mockConn{buf: new(bytes.Buffer), out: new(bytes.Buffer)}, nil
+            }
+
+            s := &SOCKS5Server{Dial: dialer}
+            err := s.request(context.Background(), conn, "")
+            if (err != nil) != tt.wantErr {
+                t.Errorf("request() error = %v, wantErr %v", err, tt.wantErr)
+                return
+            }
+            if got := conn.out.Bytes(); !bytes.Equal(got, tt.wantReply) {
+                t.Errorf("request() = %v, want %v", got, tt.wantReply)
+            }
+        })
+    }
+}
+
+// serveOne 在本地监听并用 handler 处理一个连接
+func serveOne(t *testing.T, handler func(context.Context, net.Conn) error) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- handler(context.Background(), conn)
+	}()
+	return listener.Addr().String(), errCh
+}
+
+func readReply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	t.Helper()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return buf[1], &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(buf[8])<<8 | int(buf[9])}
+}
+
+func TestBind(t *testing.T) {
+	addr, errCh := serveOne(t, (&SOCKS5Server{}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write([]byte{SOCKS5Version, Bind, 0x00, IPv4, 127, 0, 0, 1, 0, 0})
+	io.ReadFull(conn, make([]byte, 2))
+
+	rep, bindAddr := readReply(t, conn)
+	if rep != successReply {
+		t.Fatalf("first reply = %v, want %v", rep, successReply)
+	}
+	peer, err := net.DialTCP("tcp", nil, bindAddr)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+
+	rep, peerAddr := readReply(t, conn)
+	if rep != successReply {
+		t.Fatalf("second reply = %v, want %v", rep, successReply)
+	}
+	if peerAddr.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("second reply port = %v, want %v", peerAddr.Port, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+	peer.Close()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Error("bind did not finish after peer closed")
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	addr, errCh := serveOne(t, (&SOCKS5Server{BindTimeout: 50 * time.Millisecond}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write([]byte{SOCKS5Version, Bind, 0x00, IPv4, 127, 0, 0, 1, 0, 0})
+	io.ReadFull(conn, make([]byte, 2))
+
+	if rep, _ := readReply(t, conn); rep != successReply {
+		t.Fatalf("first reply = %v, want %v", rep, successReply)
+	}
+	if rep, _ := readReply(t, conn); rep != serverFailure {
+		t.Errorf("second reply = %v, want %v", rep, serverFailure)
+	}
+	if err := <-errCh; err != ErrBindTimeout {
+		t.Errorf("handleConnection() error = %v, want %v", err, ErrBindTimeout)
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	target, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	addr, _ := serveOne(t, (&SOCKS5Server{}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := target.Addr().(*net.TCPAddr).Port
+	req := []byte{SOCKS5Version, Connect, 0x00, IPv6}
+	req = append(req, net.IPv6loopback...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write(req)
+	io.ReadFull(conn, make([]byte, 2))
+
+	reply := make([]byte, 4+IPV6Len+2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != successReply || reply[3] != IPv6 {
+		t.Fatalf("reply = %v, want success with IPv6 address", reply)
+	}
+	if ip := net.IP(reply[4 : 4+IPV6Len]); !ip.Equal(net.IPv6loopback) {
+		t.Errorf("bound address = %v, want ::1", ip)
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	s := &SOCKS5Server{
+		DialTimeout: 20 * time.Millisecond,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	conn := &mockConn{buf: bytes.NewBuffer([]byte{SOCKS5Version, Connect, 0x00, IPv4, 127, 0, 0, 1, 0x1F, 0x90}), out: new(bytes.Buffer)}
+
+	if err := s.request(context.Background(), conn, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("request() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := conn.out.Bytes(); len(got) < 2 || got[1] != ttlExpired {
+		t.Errorf("request() = %v, want reply %v", got, ttlExpired)
+	}
+}
+
+func TestOutboundIP(t *testing.T) {
+	s := &SOCKS5Server{OutboundIP: net.IPv4(127, 0, 0, 2)}
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	conn, err := s.dial(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2: %v", err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(s.OutboundIP) {
+		t.Errorf("local address = %v, want %v", ip, s.OutboundIP)
+	}
+}
+
+func TestOutboundIPOtherFamily(t *testing.T) {
+	s := &SOCKS5Server{OutboundIP: net.IPv4(127, 0, 0, 1)}
+	if ip, err := s.outboundIP(true); ip != nil || err != nil {
+		t.Errorf("outboundIP(true) = %v, %v, want no binding", ip, err)
+	}
+	target, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer target.Close()
+
+	conn, err := s.dial(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("dial IPv6 target with IPv4 OutboundIP: %v", err)
+	}
+	conn.Close()
+}
+
+func TestInterfaceIP(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("169.254.0.1").To4(), Mask: net.CIDRMask(16, 32)},
+		&net.IPNet{IP: net.ParseIP("192.0.2.1").To4(), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	if ip := interfaceIP(addrs, false); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("interfaceIP(ipv4) = %v, want 192.0.2.1", ip)
+	}
+	if ip := interfaceIP(addrs, true); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("interfaceIP(ipv6) = %v, want 2001:db8::1", ip)
+	}
+	if ip := interfaceIP(addrs[:2], true); ip != nil {
+		t.Errorf("interfaceIP(link-local only) = %v, want nil", ip)
+	}
+}
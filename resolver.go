@@ -0,0 +1,63 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrNoAddress = errors.New("no address found")
+
+// NameResolver 在服务端解析目标域名
+type NameResolver interface {
+	Resolve(ctx context.Context, name string) (net.IP, error)
+}
+
+// SystemResolver 使用系统默认的解析器
+type SystemResolver struct{}
+
+func (r SystemResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	return lookupIP(ctx, net.DefaultResolver, name)
+}
+
+// DNSResolver 向指定的 DNS 服务器查询
+type DNSResolver struct {
+	// DNS 服务器地址，如 "10.0.0.53:53"
+	Server string
+	// "udp" 或 "tcp"，为空时使用 "udp"
+	Network string
+	// 单次查询超时时间，为 0 时不限制
+	Timeout time.Duration
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			//忽略系统配置的服务器，始终连接 Server
+			if r.Network != "" {
+				network = r.Network
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, r.Server)
+		},
+	}
+	return lookupIP(ctx, resolver, name)
+}
+
+func lookupIP(ctx context.Context, resolver *net.Resolver, name string) (net.IP, error) {
+	ips, err := resolver.LookupIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, ErrNoAddress
+	}
+	return ips[0], nil
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// dnsServer 启动一个只回答 A 记录的最小 DNS 服务
+func dnsServer(t *testing.T, ip net.IP) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			//跳过问题中的域名
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[end-4:])
+			resp := append([]byte{}, buf[:end]...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8180)
+			binary.BigEndian.PutUint16(resp[6:], 0)
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			if qtype == 1 {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn
+}
+
+func TestDNSResolver(t *testing.T) {
+	server := dnsServer(t, net.IPv4(10, 1, 2, 3))
+	defer server.Close()
+
+	r := &DNSResolver{Server: server.LocalAddr().String()}
+	ip, err := r.Resolve(context.Background(), "split.horizon.test")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if !ip.Equal(net.IPv4(10, 1, 2, 3)) {
+		t.Errorf("Resolve() = %v, want 10.1.2.3", ip)
+	}
+}
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ip, nil
+	}
+	return nil, ErrNoAddress
+}
+
+func TestConnectUsesResolver(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("hello"))
+	}()
+
+	s := &SOCKS5Server{Resolver: staticResolver{"target.test": net.IPv4(127, 0, 0, 1)}}
+	addr, _ := serveOne(t, s.handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := target.Addr().(*net.TCPAddr).Port
+	req := []byte{SOCKS5Version, Connect, 0x00, DomainName, 11}
+	req = append(req, "target.test"...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write(req)
+	io.ReadFull(conn, make([]byte, 2))
+
+	if rep, _ := readReply(t, conn); rep != successReply {
+		t.Fatalf("reply = %v, want %v", rep, successReply)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,198 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strings"
+)
+
+var ErrRuleFailure = errors.New("connection not allowed by ruleset")
+
+// Request 是规则判断时可见的请求信息
+type Request struct {
+	*ClientRequestMassage
+	// 客户端地址
+	ClientAddr net.Addr
+	// 认证后的用户名，未认证时为空
+	User string
+	// 直连时域名目标解析得到的 IP，解析前为 nil
+	ResolvedIP net.IP
+	// 为 true 时是建立 UDP 关联时的检查，请求中的地址是客户端的源地址而不是目标，
+	// 目标条件留到转发每个数据报时检查
+	Association bool
+}
+
+// targetIP 返回目标 IP，域名目标返回解析得到的 IP
+func (req *Request) targetIP() net.IP {
+	if ip := net.ParseIP(req.Address); ip != nil {
+		return ip
+	}
+	return req.ResolvedIP
+}
+
+// RuleSet 决定是否放行一个请求
+type RuleSet interface {
+	Allow(req *Request) bool
+}
+
+type RuleAction int
+
+const (
+	RuleAllow RuleAction = iota
+	RuleDeny
+)
+
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Rule 的各个条件之间为“与”关系，条件为空表示不限制
+type Rule struct {
+	Action   RuleAction
+	Commands []Command
+	// 目标 IP 所在网段。域名目标在直连解析后按解析得到的 IP 再检查一次
+	Networks []*net.IPNet
+	// 目标域名："example.com" 精确匹配，".example.com" 匹配该域及其子域，
+	// 含 "*" 等通配符时按 path.Match 匹配
+	Domains []string
+	Ports   []PortRange
+	// 客户端源地址所在网段
+	Sources []*net.IPNet
+	Users   []string
+	// 命中后经过的上游代理链，为空时直连
+	Upstreams []Upstream
+	// 连接目标后先发送的 PROXY 协议头版本（1 或 2），0 表示不发送
+	ProxyProtocol int
+}
+
+// Rules 按顺序匹配，第一条命中的规则生效，全部未命中时拒绝
+type Rules []Rule
+
+func (r Rules) Allow(req *Request) bool {
+	if rule := r.Match(req); rule != nil {
+		return rule.Action == RuleAllow
+	}
+	return false
+}
+
+// Match 返回第一条命中的规则，没有命中时返回 nil
+func (r Rules) Match(req *Request) *Rule {
+	for i := range r {
+		if r[i].Match(req) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Match(req *Request) bool {
+	if len(r.Commands) > 0 && !matchCommand(r.Commands, req.Cmd) {
+		return false
+	}
+	if req.Association && r.hasDestination() {
+		//带目标条件的拒绝规则只作用于数据报，放行规则先按其余条件放行关联
+		if r.Action == RuleDeny {
+			return false
+		}
+		return r.matchClient(req)
+	}
+	if len(r.Networks) > 0 && !matchNetwork(r.Networks, req.targetIP()) {
+		return false
+	}
+	if len(r.Domains) > 0 && !matchDomain(r.Domains, req.Address) {
+		return false
+	}
+	if len(r.Ports) > 0 && !matchPort(r.Ports, req.Port) {
+		return false
+	}
+	return r.matchClient(req)
+}
+
+func (r *Rule) hasDestination() bool {
+	return len(r.Networks) > 0 || len(r.Domains) > 0 || len(r.Ports) > 0
+}
+
+// matchClient 检查客户端源地址和用户条件
+func (r *Rule) matchClient(req *Request) bool {
+	if len(r.Sources) > 0 && !matchNetwork(r.Sources, addrIP(req.ClientAddr)) {
+		return false
+	}
+	if len(r.Users) > 0 && !matchUser(r.Users, req.User) {
+		return false
+	}
+	return true
+}
+
+func matchCommand(cmds []Command, cmd Command) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNetwork(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domains []string, host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		switch {
+		case strings.ContainsAny(d, "*?["):
+			if ok, _ := path.Match(d, host); ok {
+				return true
+			}
+		case strings.HasPrefix(d, "."):
+			if host == d[1:] || strings.HasSuffix(host, d) {
+				return true
+			}
+		case host == d:
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ports []PortRange, port uint16) bool {
+	for _, p := range ports {
+		if port >= p.From && port <= p.To {
+			return true
+		}
+	}
+	return false
+}
+
+func matchUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestRules(t *testing.T) {
+	rules := Rules{
+		{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}},
+		{Action: RuleDeny, Domains: []string{".internal.example.com"}},
+		{Action: RuleAllow, Users: []string{"admin"}},
+		{Action: RuleAllow, Commands: []Command{Connect}, Domains: []string{"*.example.org", "example.com"}, Ports: []PortRange{{From: 443, To: 443}}},
+		{Action: RuleAllow, Sources: []*net.IPNet{mustCIDR("192.168.0.0/16")}, Ports: []PortRange{{From: 8000, To: 8999}}},
+	}
+	client := &net.TCPAddr{IP: net.IPv4(172, 16, 0, 1), Port: 40000}
+	lan := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 40000}
+
+	tests := []struct {
+		name    string
+		cmd     Command
+		address string
+		port    uint16
+		client  net.Addr
+		user    string
+		want    bool
+	}{
+		{"Denied network", Connect, "10.1.2.3", 443, client, "admin", false},
+		{"Denied domain suffix", Connect, "db.internal.example.com", 443, client, "admin", false},
+		{"Denied domain itself", Connect, "internal.example.com", 443, client, "admin", false},
+		{"Allowed user", Connect, "8.8.8.8", 53, client, "admin", true},
+		{"Exact domain", Connect, "example.com", 443, client, "", true},
+		{"Exact domain wrong port", Connect, "example.com", 80, client, "", false},
+		{"Wildcard domain", Connect, "www.example.org", 443, client, "", true},
+		{"Wildcard does not match apex", Connect, "example.org", 443, client, "", false},
+		{"Command mismatch", Bind, "example.com", 443, client, "", false},
+		{"Source network", UDPAssociate, "1.1.1.1", 8080, lan, "", true},
+		{"Source network wrong port", UDPAssociate, "1.1.1.1", 9000, lan, "", false},
+		{"No match", Connect, "1.1.1.1", 443, client, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				ClientRequestMassage: &ClientRequestMassage{Cmd: tt.cmd, Address: tt.address, Port: tt.port},
+				ClientAddr:           tt.client,
+				User:                 tt.user,
+			}
+			if got := rules.Allow(req); got != tt.want {
+				t.Errorf("Allow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestRuleFailure(t *testing.T) {
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleDeny}}}
+	conn := &mockConn{buf: bytes.NewBuffer([]byte{SOCKS5Version, Connect, 0x00, IPv4, 10, 0, 0, 1, 0x1F, 0x90})}
+
+	if err := s.request(context.Background(), conn, ""); err != ErrRuleFailure {
+		t.Errorf("request() error = %v, want %v", err, ErrRuleFailure)
+	}
+	want := []byte{SOCKS5Version, ruleFailure, 0x00, IPv4, 0, 0, 0, 0, 0, 0}
+	if got := conn.buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("request() = %v, want %v", got, want)
+	}
+}
+
+func TestRulesResolvedIP(t *testing.T) {
+	rules := Rules{
+		{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("10.0.0.0/8")}},
+		{Action: RuleAllow},
+	}
+	req := &Request{ClientRequestMassage: &ClientRequestMassage{Cmd: Connect, AddrType: DomainName, Address: "intranet.test", Port: 80}}
+	if !rules.Allow(req) {
+		t.Error("domain denied before resolution")
+	}
+	req.ResolvedIP = net.IPv4(10, 1, 2, 3)
+	if rules.Allow(req) {
+		t.Error("domain resolving into denied network allowed")
+	}
+	req.ResolvedIP = net.IPv4(8, 8, 8, 8)
+	if !rules.Allow(req) {
+		t.Error("domain resolving outside denied network denied")
+	}
+}
+
+func TestConnectDeniedByResolvedIP(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	s := &SOCKS5Server{
+		Resolver: staticResolver{"loopback.test": net.IPv4(127, 0, 0, 1)},
+		Rules: Rules{
+			{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("127.0.0.0/8")}},
+			{Action: RuleAllow},
+		},
+	}
+	addr, errCh := serveOne(t, s.handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := target.Addr().(*net.TCPAddr).Port
+	req := []byte{SOCKS5Version, Connect, 0x00, DomainName, 13}
+	req = append(req, "loopback.test"...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write(req)
+	io.ReadFull(conn, make([]byte, 2))
+
+	if rep, _ := readReply(t, conn); rep != ruleFailure {
+		t.Errorf("reply = %v, want %v", rep, ruleFailure)
+	}
+	if err := <-errCh; !errors.Is(err, ErrRuleFailure) {
+		t.Errorf("serve error = %v, want %v", err, ErrRuleFailure)
+	}
+}
+
+func TestRulesAssociation(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	tests := []struct {
+		name  string
+		rules Rules
+		want  bool
+	}{
+		{"Allow with destination", Rules{{Action: RuleAllow, Ports: []PortRange{{From: 53, To: 53}}}}, true},
+		{"Deny with destination", Rules{{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("127.0.0.0/8")}}, {Action: RuleAllow}}, true},
+		{"Deny command", Rules{{Action: RuleDeny, Commands: []Command{UDPAssociate}}, {Action: RuleAllow}}, false},
+		{"Allow other user", Rules{{Action: RuleAllow, Users: []string{"admin"}, Ports: []PortRange{{From: 53, To: 53}}}}, false},
+		{"Deny source", Rules{{Action: RuleDeny, Sources: []*net.IPNet{mustCIDR("127.0.0.0/8")}}, {Action: RuleAllow}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				ClientRequestMassage: &ClientRequestMassage{Cmd: UDPAssociate, AddrType: IPv4, Address: "127.0.0.1", Port: 40001},
+				ClientAddr:           client,
+				Association:          true,
+			}
+			if got := tt.rules.Allow(req); got != tt.want {
+				t.Errorf("Allow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
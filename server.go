@@ -0,0 +1,232 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrServerClosed = errors.New("socks5: server closed")
+
+const shutdownPollInterval = 100 * time.Millisecond
+
+// ListenAndServe 监听 IP:Port 并处理连接，设置 TLS 时使用 TLS 监听，设置 AdminAddr 时同时提供管理接口，
+// ctx 结束时立即关闭服务
+func (s *SOCKS5Server) ListenAndServe(ctx context.Context) error {
+	if s.inShutdown.Load() {
+		return ErrServerClosed
+	}
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if s.AdminAddr != "" {
+		adminListener, err := net.Listen("tcp", s.AdminAddr)
+		if err != nil {
+			return err
+		}
+		admin := &http.Server{Handler: s.AdminHandler()}
+		go admin.Serve(adminListener)
+		defer admin.Close()
+	}
+	address := net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+	return s.serveListener(ctx, listener, s.TLS != nil)
+}
+
+// Serve 在 l 上接受连接，直到 Shutdown 或 Close 被调用
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	return s.serveListener(context.Background(), l, false)
+}
+
+// ServeTLS 与 Serve 相同，但使用 s.TLS 的配置接受 TLS 连接
+func (s *SOCKS5Server) ServeTLS(l net.Listener) error {
+	return s.serveListener(context.Background(), l, true)
+}
+
+// serveListener 依次套上 PROXY 协议解析和 TLS 后开始服务
+func (s *SOCKS5Server) serveListener(ctx context.Context, l net.Listener, useTLS bool) error {
+	if len(s.ProxyProtocolTrusted) > 0 {
+		l = &proxyProtoListener{Listener: l, trusted: s.ProxyProtocolTrusted}
+	}
+	if useTLS {
+		tlsListener, err := s.tlsListener(l)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tlsListener
+	}
+	return s.serve(ctx, l, s.handleConnection)
+}
+
+// serve 在 l 上接受连接，并为每个连接启动 handler
+func (s *SOCKS5Server) serve(ctx context.Context, l net.Listener, handler func(context.Context, net.Conn) error) error {
+	if !s.trackListener(&l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			//临时错误，退避后重试
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if tempDelay > time.Second {
+				tempDelay = time.Second
+			}
+			s.logger().Error("accept failed", "err", err, "retry_in", tempDelay)
+			time.Sleep(tempDelay)
+			continue
+		}
+		tempDelay = 0
+		s.metrics.connections.Add(1)
+
+		connCtx, cancel := context.WithCancel(ctx)
+		s.trackConn(conn, cancel, true)
+		go func() {
+			defer s.trackConn(conn, nil, false)
+			defer cancel()
+			defer conn.Close()
+			//RemoteAddr 可能需要读取 PROXY 协议头，不能在接受循环中调用
+			connCtx := s.withLogAttrs(connCtx, "conn", s.nextConnID.Add(1), "client", conn.RemoteAddr().String())
+			s.log(connCtx).Debug("connection accepted")
+			err := handler(connCtx, conn)
+			s.log(connCtx).Debug("connection closed", "err", err)
+		}()
+	}
+}
+
+// Shutdown 停止接受新连接并等待已有连接结束，ctx 结束时强制关闭剩余连接
+func (s *SOCKS5Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		s.closeIdleConnsLocked()
+		s.mu.Unlock()
+		if s.activeConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.closeConnsLocked()
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭所有监听和连接
+func (s *SOCKS5Server) Close() error {
+	s.inShutdown.Store(true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListenersLocked()
+	s.closeConnsLocked()
+	return err
+}
+
+func (s *SOCKS5Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *SOCKS5Server) trackConn(conn net.Conn, cancel context.CancelFunc, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]context.CancelFunc)
+	}
+	if add {
+		s.conns[conn] = cancel
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// setIdle 标记连接是否空闲，服务正在关闭时不能再进入空闲并返回 false
+func (s *SOCKS5Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !idle {
+		delete(s.idleConns, conn)
+		return true
+	}
+	if s.inShutdown.Load() {
+		return false
+	}
+	if s.idleConns == nil {
+		s.idleConns = make(map[net.Conn]struct{})
+	}
+	s.idleConns[conn] = struct{}{}
+	return true
+}
+
+func (s *SOCKS5Server) closeIdleConnsLocked() {
+	for conn := range s.idleConns {
+		conn.Close()
+	}
+}
+
+func (s *SOCKS5Server) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *SOCKS5Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *SOCKS5Server) closeConnsLocked() {
+	for conn, cancel := range s.conns {
+		cancel()
+		conn.Close()
+	}
+}
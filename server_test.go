@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectTunnel 通过 SOCKS5 服务建立到 target 的 CONNECT 隧道
+func connectTunnel(t *testing.T, proxy string, target *net.TCPAddr) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{SOCKS5Version, Connect, 0x00, IPv4}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write(req)
+	io.ReadFull(conn, make([]byte, 2))
+	if rep, _ := readReply(t, conn); rep != successReply {
+		t.Fatalf("reply = %v, want %v", rep, successReply)
+	}
+	return conn
+}
+
+func tcpEcho(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func startServer(t *testing.T, s *SOCKS5Server) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Serve(l) }()
+	return l.Addr().String(), errCh
+}
+
+func TestShutdownDrains(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{}
+	addr, serveErr := startServer(t, s)
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		conn.Close()
+	}()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Errorf("Serve() error = %v, want %v", err, ErrServerClosed)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepting after Shutdown")
+	}
+}
+
+func TestShutdownForceCloses(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("tunnel read error = %v, want EOF", err)
+	}
+	if n := s.activeConns(); n != 0 {
+		time.Sleep(50 * time.Millisecond)
+		if n = s.activeConns(); n != 0 {
+			t.Errorf("active connections = %d after forced shutdown", n)
+		}
+	}
+}
+
+func TestListenAndServeContext(t *testing.T) {
+	s := &SOCKS5Server{IP: "127.0.0.1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.ListenAndServe(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != ErrServerClosed {
+			t.Errorf("ListenAndServe() error = %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return after context cancel")
+	}
+}
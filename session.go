@@ -0,0 +1,189 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session 记录一次请求从开始到结束的状态，CONNECT 和 BIND 对应一条隧道，
+// UDP ASSOCIATE 对应一个关联
+type session struct {
+	id      uint64
+	start   time.Time
+	client  net.Addr
+	user    string
+	command string
+	dest    string
+	// 客户端发往目标和目标发往客户端的字节数
+	in, out atomic.Uint64
+	// 请求所在的客户端连接，关闭它即可结束会话
+	conn   net.Conn
+	cancel context.CancelFunc
+	killed atomic.Bool
+
+	mu         sync.Mutex
+	resolvedIP net.IP
+	// 最后一次应答码，-1 表示尚未应答
+	reply int
+}
+
+func newSession(conn net.Conn, clientMessage *ClientRequestMassage, user string, cancel context.CancelFunc) *session {
+	return &session{
+		conn:    conn,
+		cancel:  cancel,
+		start:   time.Now(),
+		client:  conn.RemoteAddr(),
+		user:    user,
+		command: commandName(clientMessage.Cmd),
+		dest:    net.JoinHostPort(clientMessage.Address, strconv.Itoa(int(clientMessage.Port))),
+		reply:   -1,
+	}
+}
+
+// recordReply 包装 reply，记录发送的应答码
+func (sess *session) recordReply(reply replyFunc) replyFunc {
+	return func(rep uint8, addr *AddrSpec) error {
+		sess.mu.Lock()
+		sess.reply = int(rep)
+		sess.mu.Unlock()
+		return reply(rep, addr)
+	}
+}
+
+func (sess *session) setResolvedIP(ip net.IP) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.resolvedIP = ip
+}
+
+// record 返回会话当前的摘要，end 为零值表示会话仍在进行
+func (sess *session) record(end time.Time, reason string) *AccessRecord {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	r := &AccessRecord{
+		Start:       sess.start,
+		End:         end,
+		Client:      sess.client.String(),
+		User:        sess.user,
+		Command:     sess.command,
+		Dest:        sess.dest,
+		Reply:       sess.reply,
+		BytesIn:     sess.in.Load(),
+		BytesOut:    sess.out.Load(),
+		CloseReason: reason,
+	}
+	if sess.resolvedIP != nil {
+		r.ResolvedIP = sess.resolvedIP.String()
+	}
+	return r
+}
+
+// closeReason 将请求返回的错误转为访问日志中的关闭原因
+func closeReason(err error) string {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return "closed"
+	}
+	return err.Error()
+}
+
+// kill 关闭客户端连接以结束会话
+func (sess *session) kill() {
+	sess.killed.Store(true)
+	sess.cancel()
+	sess.conn.Close()
+}
+
+// SessionInfo 是一个活动会话的快照
+type SessionInfo struct {
+	ID         uint64    `json:"id"`
+	Start      time.Time `json:"start"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Command    string    `json:"command"`
+	Dest       string    `json:"dest"`
+	ResolvedIP string    `json:"resolved_ip,omitempty"`
+	Reply      int       `json:"reply"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+}
+
+func (sess *session) info() SessionInfo {
+	r := sess.record(time.Time{}, "")
+	return SessionInfo{
+		ID:         sess.id,
+		Start:      r.Start,
+		Client:     r.Client,
+		User:       r.User,
+		Command:    r.Command,
+		Dest:       r.Dest,
+		ResolvedIP: r.ResolvedIP,
+		Reply:      r.Reply,
+		BytesIn:    r.BytesIn,
+		BytesOut:   r.BytesOut,
+	}
+}
+
+func (s *SOCKS5Server) trackSession(sess *session, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*session)
+	}
+	if add {
+		sess.id = s.nextSessID.Add(1)
+		s.sessions[sess.id] = sess
+	} else {
+		delete(s.sessions, sess.id)
+	}
+}
+
+// Sessions 返回按编号排序的活动会话
+func (s *SOCKS5Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	infos := make([]SessionInfo, len(sessions))
+	for i, sess := range sessions {
+		infos[i] = sess.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// KillSession 结束编号为 id 的会话，会话不存在时返回 false
+func (s *SOCKS5Server) KillSession(id uint64) bool {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if ok {
+		sess.kill()
+	}
+	return ok
+}
+
+// KillSessions 结束 match 返回 true 的全部会话，返回结束的数量
+func (s *SOCKS5Server) KillSessions(match func(SessionInfo) bool) int {
+	s.mu.Lock()
+	var matched []*session
+	for _, sess := range s.sessions {
+		if match(sess.info()) {
+			matched = append(matched, sess)
+		}
+	}
+	s.mu.Unlock()
+	for _, sess := range matched {
+		sess.kill()
+	}
+	return len(matched)
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+const (
+	SOCKS4Version = 0x04
+	// SOCKS4 应答
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// USERID 和 SOCKS4a 域名的最大长度
+const socks4MaxField = 255
+
+var ErrSOCKS4AuthRequired = errors.New("socks4 not allowed when authentication is required")
+var ErrSOCKS4FieldTooLong = errors.New("socks4 field too long")
+
+type SOCKS4RequestMassage struct {
+	ClientRequestMassage
+	UserID string
+}
+
+func NewSOCKS4RequestMassage(conn net.Conn) (*SOCKS4RequestMassage, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	//检查
+	version, command := buf[0], buf[1]
+	if version != SOCKS4Version {
+		return nil, ErrVersion
+	}
+	if command != Connect && command != Bind {
+		return nil, ErrUnsupportedCommand
+	}
+	port := binary.BigEndian.Uint16(buf[2:4])
+	ip := net.IP(buf[4:8])
+	userID, err := readNullString(conn)
+	if err != nil {
+		return nil, err
+	}
+	msg := &SOCKS4RequestMassage{
+		ClientRequestMassage: ClientRequestMassage{
+			Cmd:      command,
+			AddrType: IPv4,
+			Address:  ip.String(),
+			Port:     port,
+		},
+		UserID: userID,
+	}
+	//SOCKS4a：DSTIP 为 0.0.0.x 时域名跟在 USERID 之后
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullString(conn)
+		if err != nil {
+			return nil, err
+		}
+		msg.AddrType = DomainName
+		msg.Address = domain
+	}
+	return msg, nil
+}
+
+// readNullString 读取以 NUL 结尾的字段
+func readNullString(conn net.Conn) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxField {
+			return "", ErrSOCKS4FieldTooLong
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+// SendSOCKS4Reply 发送 SOCKS4 应答，rep 为 SOCKS5 应答码
+func SendSOCKS4Reply(conn net.Conn, rep uint8, addr *AddrSpec) error {
+	reply := make([]byte, 8)
+	reply[1] = socks4Rejected
+	if rep == successReply {
+		reply[1] = socks4Granted
+	}
+	if addr != nil {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(addr.Port))
+		if ip := addr.IP.To4(); ip != nil {
+			copy(reply[4:], ip)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+func (s *SOCKS5Server) handleSOCKS4(ctx context.Context, conn net.Conn, identity string) error {
+	clientMessage, err := NewSOCKS4RequestMassage(conn)
+	if err != nil {
+		s.handshakeFailed(ctx, err)
+		return err
+	}
+	//USERID 由客户端自报，只记入日志，不作为认证用户
+	if clientMessage.UserID != "" {
+		ctx = s.withLogAttrs(ctx, "socks4_userid", clientMessage.UserID)
+	}
+	//SOCKS4 无法认证，只在允许无认证时提供
+	if !s.acceptsNoAuth() {
+		s.handshakeFailed(ctx, ErrSOCKS4AuthRequired)
+		SendSOCKS4Reply(conn, ruleFailure, nil)
+		return ErrSOCKS4AuthRequired
+	}
+	reply := func(rep uint8, addr *AddrSpec) error {
+		return SendSOCKS4Reply(conn, rep, addr)
+	}
+	return s.serveRequest(ctx, conn, &clientMessage.ClientRequestMassage, identity, reply)
+}
+
+func (s *SOCKS5Server) acceptsNoAuth() bool {
+	for _, a := range s.authenticators() {
+		if a.Method() == NoAuth {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestNewSOCKS4RequestMassage(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		wantAddr string
+		wantUser string
+		wantErr  bool
+	}{
+		{
+			name:     "SOCKS4 Connect",
+			input:    []byte{SOCKS4Version, Connect, 0x1F, 0x90, 192, 168, 0, 1, 'b', 'o', 'b', 0},
+			wantAddr: "192.168.0.1",
+			wantUser: "bob",
+		},
+		{
+			name:     "SOCKS4a domain",
+			input:    []byte{SOCKS4Version, Connect, 0x1F, 0x90, 0, 0, 0, 1, 0, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0},
+			wantAddr: "example.com",
+		},
+		{
+			name:    "Unsupported command",
+			input:   []byte{SOCKS4Version, UDPAssociate, 0x1F, 0x90, 192, 168, 0, 1, 0},
+			wantErr: true,
+		},
+		{
+			name:    "Missing terminator",
+			input:   []byte{SOCKS4Version, Connect, 0x1F, 0x90, 192, 168, 0, 1, 'b', 'o', 'b'},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &mockConn{buf: bytes.NewBuffer(tt.input)}
+			msg, err := NewSOCKS4RequestMassage(conn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSOCKS4RequestMassage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if msg.Address != tt.wantAddr || msg.UserID != tt.wantUser || msg.Port != 8080 {
+				t.Errorf("NewSOCKS4RequestMassage() = %+v", msg)
+			}
+		})
+	}
+}
+
+func socks4Connect(t *testing.T, proxy string, req []byte) (net.Conn, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(req)
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	return conn, reply
+}
+
+func TestSOCKS4Connect(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+	s := &SOCKS5Server{Resolver: staticResolver{"echo.test": net.IPv4(127, 0, 0, 1)}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	requests := map[string][]byte{
+		"SOCKS4":  {SOCKS4Version, Connect, byte(port >> 8), byte(port), 127, 0, 0, 1, 0},
+		"SOCKS4a": append([]byte{SOCKS4Version, Connect, byte(port >> 8), byte(port), 0, 0, 0, 1, 'u', 0}, "echo.test\x00"...),
+	}
+	for name, req := range requests {
+		t.Run(name, func(t *testing.T) {
+			conn, reply := socks4Connect(t, addr, req)
+			defer conn.Close()
+			if reply[0] != 0 || reply[1] != socks4Granted {
+				t.Fatalf("reply = %v, want granted", reply)
+			}
+			echoRoundTrip(t, conn)
+		})
+	}
+}
+
+func TestSOCKS4Bind(t *testing.T) {
+	s := &SOCKS5Server{}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, reply := socks4Connect(t, addr, []byte{SOCKS4Version, Bind, 0, 0, 127, 0, 0, 1, 0})
+	defer conn.Close()
+	if reply[1] != socks4Granted {
+		t.Fatalf("first reply = %v, want granted", reply)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[2])<<8 | int(reply[3])}
+	peer, err := net.DialTCP("tcp", nil, bindAddr)
+	if err != nil {
+		t.Fatalf("dial bind address: %v", err)
+	}
+	defer peer.Close()
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks4Granted {
+		t.Fatalf("second reply = %v, %v", reply, err)
+	}
+	peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("relay got %q, %v", buf, err)
+	}
+}
+
+func TestSOCKS4Rejected(t *testing.T) {
+	req := []byte{SOCKS4Version, Connect, 0, 80, 127, 0, 0, 1, 0}
+	servers := map[string]*SOCKS5Server{
+		"Rule":          {Rules: Rules{{Action: RuleDeny}}},
+		"Auth required": {Credentials: StaticCredentials{"user": "pass"}},
+	}
+	for name, s := range servers {
+		t.Run(name, func(t *testing.T) {
+			addr, _ := startServer(t, s)
+			defer s.Close()
+			conn, reply := socks4Connect(t, addr, req)
+			defer conn.Close()
+			if reply[1] != socks4Rejected {
+				t.Errorf("reply = %v, want rejected", reply)
+			}
+		})
+	}
+}
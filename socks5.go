@@ -1,321 +1,738 @@
-package socks5
-
-import (
-	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
-	"log"
-	"net"
-	"strings"
-	"sync"
-
-	"github.com/sirupsen/logrus"
-)
-
-type Server interface {
-	Run() error
-}
-
-type SOCKS5Server struct {
-	IP   string
-	Port int
-}
-type SenderMap struct {
-	sync.Map
-}
-
-const MaxSegmentSize = 65535
-
-const UDPprot = 1080
-
-var senders SenderMap
-var client SenderMap
-
-func (p *SenderMap) Get(key string) (net.PacketConn, bool) {
-	v, exist := p.Load(key)
-	if !exist {
-		return nil, false
-	}
-
-	return v.(net.PacketConn), true
-}
-
-func (p *SenderMap) Del(key string) net.PacketConn {
-	if conn, exist := p.Get(key); exist {
-		p.Map.Delete(key)
-		return conn
-	}
-
-	return nil
-}
-
-func (s *SOCKS5Server) Run() error {
-	address := fmt.Sprintf("%s:%d", s.IP, s.Port)
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		return err
-	}
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("连接出现错误，地址为%s,%s", conn.RemoteAddr(), err)
-			continue
-		}
-
-		go func() {
-			defer conn.Close()
-			err := handleConnection(conn)
-			if err != nil {
-				log.Printf("处理错误，地址为%s,%s", conn.RemoteAddr(), err)
-			}
-		}()
-	}
-}
-
-func handleConnection(conn net.Conn) error {
-	//协商
-	if err := auth(conn); err != nil {
-		return err
-	}
-	//请求
-	err := request(conn)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func auth(conn net.Conn) error {
-	clientMessage, err := NewClientAuthMassage(conn)
-	if err != nil {
-		return err
-	}
-	log.Printf("客户端消息：%v", clientMessage)
-	var acc bool
-	for _, method := range clientMessage.Methods {
-		if method == NoAuth {
-			acc = true
-			break
-		}
-	}
-	if !acc {
-		NewServerAuthMassage(conn, NoAcceptable)
-		return errors.New("没有合适的方法")
-	}
-	return NewServerAuthMassage(conn, NoAuth)
-}
-
-func request(conn net.Conn) error {
-	clientMessage, err := NewClientRequestMassage(conn)
-	if err != nil {
-		return err
-	}
-	if clientMessage.Cmd == Bind {
-		return SendReply(conn, commandNotSupported, nil)
-	}
-	if clientMessage.Cmd == UDPAssociate {
-		return handleUDPAssociate(conn, clientMessage)
-	}
-	if clientMessage.AddrType == IPv6 {
-		return SendReply(conn, addrTypeNotSupported, nil)
-	}
-	return handleTCPRequest(conn, clientMessage)
-}
-
-func handleTCPRequest(conn net.Conn, clientMessage *ClientRequestMassage) error {
-	//请求访问目标TCP服务
-	address := fmt.Sprintf("%s:%d", clientMessage.Address, clientMessage.Port)
-	targetConn, err := net.Dial("tcp", address)
-	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
-		}
-
-		return SendReply(conn, resp, nil)
-	}
-	//发送成功报文
-	addrValue := targetConn.LocalAddr()
-	addr := addrValue.(*net.TCPAddr)
-	addrSpec := &AddrSpec{
-		IP:   addr.IP,
-		Port: addr.Port,
-	}
-	err = SendReply(conn, successReply, addrSpec)
-	if err != nil {
-		return err
-	}
-	return tcpForward(conn, targetConn)
-}
-
-func handleUDPAssociate(conn net.Conn, clientMessage *ClientRequestMassage) error {
-	addrSpec := &AddrSpec{
-		Port: UDPprot,
-	}
-	err := SendReply(conn, successReply, addrSpec)
-	if err != nil {
-		return err
-	}
-	//将客户端地址储存起来
-	clientAddr := conn.RemoteAddr().String()
-	client.Store(conn, clientAddr)
-	//接收转发客户端的UDP数据包
-	go udpForward(addrSpec)
-	return nil
-}
-
-func udpForward(addrSpec *AddrSpec) {
-	listenAddr := &net.UDPAddr{
-		IP:   addrSpec.IP,
-		Port: addrSpec.Port,
-	}
-	relayer, err := net.ListenUDP("udp", listenAddr)
-	if err != nil {
-		return
-	}
-	for {
-		buf := make([]byte, MaxSegmentSize)
-
-		n, addr, err := relayer.ReadFrom(buf)
-		if err != nil {
-			continue
-		}
-		saddr := addr.String()
-		_, exist := client.Get(saddr)
-		if !exist {
-			//无视没有协商的客户端
-			continue
-		}
-		sender, exist := senders.Get(saddr)
-		if !exist {
-			sender, err = net.ListenPacket("udp", "")
-			if err != nil {
-				continue
-			}
-			senders.Store(addr.String(), sender)
-
-			go func() {
-				relayToClient(sender, relayer, addr)
-				if sender := senders.Del(saddr); sender != nil {
-					sender.Close()
-				}
-			}()
-		}
-
-		err = relayToRemote(sender, buf[0:n])
-		if err != nil {
-			continue
-		}
-	}
-}
-
-func relayToClient(receiver net.PacketConn, relayer net.PacketConn, clientAddr net.Addr) error {
-	buf := make([]byte, MaxSegmentSize)
-
-	for {
-		n, addr, err := receiver.ReadFrom(buf)
-		if err != nil {
-			return err
-		}
-
-		bAddr, err := NewAddrByteFromString(addr.String())
-		if err != nil {
-			return err
-		}
-
-		_, err = relayer.WriteTo(NewUDPDatagram(bAddr, buf[:n]).ToBytes(), clientAddr)
-		if err != nil {
-			return err
-		}
-	}
-}
-
-func relayToRemote(sender net.PacketConn, datagram []byte) error {
-	d, err := NewUDPDatagramFromBytes(datagram)
-	if err != nil {
-		return err
-	}
-	if d.Frag != 0x00 { //不支持udp分片
-		return ErrUDPFrag
-	}
-
-	udpTargetAddr := d.Address()
-
-	tgtUDPAddr, err := net.ResolveUDPAddr("udp", udpTargetAddr)
-	if err != nil {
-		return err
-	}
-
-	logrus.Debug("udp req:", udpTargetAddr)
-
-	_, err = sender.WriteTo(d.Data, tgtUDPAddr)
-	return err
-}
-
-func parseFrame(buffer []byte, atyp byte) (net.IP, uint16, []byte, error) {
-	var dstAddr net.IP
-	var dstPort uint16
-	var data []byte
-
-	switch atyp {
-	case 0x01: // IPv4
-		if len(buffer) < 7 {
-			return nil, 0, nil, fmt.Errorf("无效的IPv4帧长度")
-		}
-		dstAddr = net.IPv4(buffer[0], buffer[1], buffer[2], buffer[3])
-		dstPort = binary.BigEndian.Uint16(buffer[4:6])
-		data = buffer[6:]
-	case 0x03: // 域名
-		domainLen := int(buffer[0])
-		if len(buffer) < 2+domainLen+2 {
-			return nil, 0, nil, fmt.Errorf("无效的域名帧长度")
-		}
-		dstAddr = net.IP(buffer[1 : 1+domainLen])
-		dstPort = binary.BigEndian.Uint16(buffer[1+domainLen : 1+domainLen+2])
-		data = buffer[1+domainLen+2:]
-	case 0x04: // IPv6
-		if len(buffer) < 19 {
-			return nil, 0, nil, fmt.Errorf("无效的IPv6帧长度")
-		}
-		dstAddr = net.IP(buffer[0:16])
-		dstPort = binary.BigEndian.Uint16(buffer[16:18])
-		data = buffer[18:]
-	default:
-		return nil, 0, nil, fmt.Errorf("不支持的地址类型: %d", atyp)
-	}
-
-	return dstAddr, dstPort, data, nil
-}
-
-func buildFrame(dstAddr net.IP, dstPort uint16, data []byte) []byte {
-	var frame []byte
-	frame = append(frame, 0x00, 0x00) // RSV
-	frame = append(frame, 0x00)       // FRAG
-
-	if dstAddr.To4() != nil {
-		frame = append(frame, 0x01) // ATYP (IPv4)
-		frame = append(frame, dstAddr.To4()...)
-	} else if dstAddr.To16() != nil {
-		frame = append(frame, 0x04) // ATYP (IPv6)
-		frame = append(frame, dstAddr.To16()...)
-	} else {
-		// 不支持的地址类型
-		return nil
-	}
-
-	frame = append(frame, byte(dstPort>>8), byte(dstPort&0xff)) // DST.PORT
-	frame = append(frame, data...)                              // DATA
-
-	return frame
-}
-
-func tcpForward(conn net.Conn, targetConn net.Conn) error {
-	defer targetConn.Close()
-	go io.Copy(targetConn, conn)
-	_, err := io.Copy(conn, targetConn)
-	return err
-}
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server interface {
+	Run() error
+}
+
+type SOCKS5Server struct {
+	IP   string
+	Port int
+	// 监听网络类型："tcp"、"tcp4" 或 "tcp6"，为空时使用 "tcp"
+	Network string
+	// 非空时要求客户端使用用户名/密码认证
+	Credentials CredentialStore
+	// 按服务端偏好排列的认证方法，为空时根据 Credentials 决定
+	Authenticators []Authenticator
+	// BIND 等待入站连接的超时时间，为 0 时使用 DefaultBindTimeout
+	BindTimeout time.Duration
+	// 为 true 时 BIND 只接受来自 DST.ADDR 的入站连接
+	BindCheckAddr bool
+	// UDP 分片重组超时时间，为 0 时使用 DefaultReassemblyTimeout
+	UDPReassemblyTimeout time.Duration
+	// 非空时在执行请求前检查规则，拒绝时回复 ruleFailure
+	Rules RuleSet
+	// 目标域名的解析器，为空时使用 SystemResolver
+	Resolver NameResolver
+	// 自定义出站拨号函数，设置后忽略 OutboundIP、OutboundInterface 和 KeepAlive
+	Dial DialFunc
+	// 出站连接绑定的本地 IP，优先于 OutboundInterface，只用于同地址族的目标
+	OutboundIP net.IP
+	// 出站连接使用的网卡，取该网卡上与目标同地址族的地址
+	OutboundInterface string
+	// 出站连接超时时间，为 0 时不限制
+	DialTimeout time.Duration
+	// 出站 TCP keep-alive 间隔，为 0 时使用系统默认值，为负数时关闭
+	KeepAlive time.Duration
+	// 非空时 ListenAndServe 使用 TLS 监听
+	TLS *TLSConfig
+	// 非空时来自这些网段的连接必须带 PROXY 协议头，并以其中的源地址作为客户端地址
+	ProxyProtocolTrusted []*net.IPNet
+	// 非空时 ListenAndServe 同时在该地址上提供管理接口，见 AdminHandler
+	AdminAddr string
+	// 日志记录器，为空时使用 slog.Default()。逐个请求的信息使用 Debug 级别
+	Logger *slog.Logger
+	// 非空时每个请求结束后写入一条访问日志
+	AccessLog *AccessLog
+	// 非空时对 TCP 隧道和 UDP 中继限速
+	Throttle *Throttle
+
+	metrics    metrics
+	nextConnID atomic.Uint64
+	sessions   map[uint64]*session
+	nextSessID atomic.Uint64
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	conns      map[net.Conn]context.CancelFunc
+	// 在两个 HTTP 请求之间空闲的连接，Shutdown 时直接关闭
+	idleConns  map[net.Conn]struct{}
+	inShutdown atomic.Bool
+}
+
+const MaxSegmentSize = 65535
+
+const DefaultBindTimeout = 2 * time.Minute
+
+var ErrBindTimeout = errors.New("bind: no incoming connection")
+
+// UDP 中继解析单个数据报目标域名的超时时间，解析期间该关联的其他数据报需等待
+const udpResolveTimeout = 5 * time.Second
+
+func (s *SOCKS5Server) Run() error {
+	return s.ListenAndServe(context.Background())
+}
+
+func (s *SOCKS5Server) handleConnection(ctx context.Context, conn net.Conn) error {
+	//TLS 客户端证书提供的身份，在没有其他认证用户时使用
+	var identity string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			s.handshakeFailed(ctx, err)
+			return err
+		}
+		identity = tlsIdentity(tlsConn)
+	}
+	//根据第一个字节区分 SOCKS4 和 SOCKS5
+	br := bufio.NewReader(conn)
+	version, err := br.Peek(1)
+	if err != nil {
+		s.handshakeFailed(ctx, err)
+		return err
+	}
+	conn = &bufferedConn{Conn: conn, r: br}
+	if version[0] == SOCKS4Version {
+		return s.handleSOCKS4(ctx, conn, identity)
+	}
+	if isHTTPMethodByte(version[0]) {
+		return s.handleHTTP(ctx, conn, br, identity)
+	}
+	//协商
+	user, err := s.auth(conn)
+	if err != nil {
+		s.handshakeFailed(ctx, err)
+		return err
+	}
+	if user == "" {
+		user = identity
+	}
+	if user != "" {
+		ctx = s.withLogAttrs(ctx, "user", user)
+	}
+	//请求
+	err = s.request(ctx, conn, user)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *SOCKS5Server) authenticators() []Authenticator {
+	if len(s.Authenticators) > 0 {
+		return s.Authenticators
+	}
+	if s.Credentials != nil {
+		return []Authenticator{UserPassAuthenticator{Credentials: s.Credentials}}
+	}
+	return []Authenticator{NoAuthAuthenticator{}}
+}
+
+func (s *SOCKS5Server) auth(conn net.Conn) (string, error) {
+	clientMessage, err := NewClientAuthMassage(conn)
+	if err != nil {
+		return "", err
+	}
+	//按服务端偏好选择客户端提供的方法
+	var authenticator Authenticator
+	for _, a := range s.authenticators() {
+		for _, method := range clientMessage.Methods {
+			if method == a.Method() {
+				authenticator = a
+				break
+			}
+		}
+		if authenticator != nil {
+			break
+		}
+	}
+	if authenticator == nil {
+		NewServerAuthMassage(conn, NoAcceptable)
+		return "", ErrNoAcceptableMethod
+	}
+	if err := NewServerAuthMassage(conn, authenticator.Method()); err != nil {
+		return "", err
+	}
+	return authenticator.Authenticate(conn)
+}
+
+// replyFunc 按客户端使用的协议发送应答
+type replyFunc func(rep uint8, addr *AddrSpec) error
+
+func (s *SOCKS5Server) request(ctx context.Context, conn net.Conn, user string) error {
+	clientMessage, err := NewClientRequestMassage(conn)
+	if err != nil {
+		s.handshakeFailed(ctx, err)
+		return err
+	}
+	reply := func(rep uint8, addr *AddrSpec) error {
+		return SendReply(conn, rep, addr)
+	}
+	return s.serveRequest(ctx, conn, clientMessage, user, reply)
+}
+
+// relayFunc 在 CONNECT 连接目标并应答成功后转发数据
+type relayFunc func(ctx context.Context, conn net.Conn, targetConn net.Conn, sess *session) error
+
+// serveRequest 执行 SOCKS4 与 SOCKS5 共用的规则检查和命令处理
+func (s *SOCKS5Server) serveRequest(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, user string, reply replyFunc) error {
+	return s.serveRequestRelay(ctx, conn, clientMessage, user, reply, s.tcpForward)
+}
+
+// serveRequestRelay 与 serveRequest 相同，但 CONNECT 成功后由 relay 转发数据
+func (s *SOCKS5Server) serveRequestRelay(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, user string, reply replyFunc, relay relayFunc) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess := newSession(conn, clientMessage, user, cancel)
+	s.trackSession(sess, true)
+	defer func() {
+		s.trackSession(sess, false)
+		s.finishSession(ctx, sess, err)
+	}()
+	reply = sess.recordReply(s.metrics.countReplies(reply))
+	ctx = s.withLogAttrs(ctx, "session", sess.id, "cmd", sess.command, "dest", sess.dest)
+	s.log(ctx).Debug("request")
+	//规则检查
+	out, ok := s.route(conn, clientMessage, user)
+	if !ok {
+		s.log(ctx).Info("request denied by rules")
+		reply(ruleFailure, nil)
+		return ErrRuleFailure
+	}
+	if clientMessage.Cmd == Bind {
+		return s.handleBind(ctx, conn, clientMessage, sess, reply)
+	}
+	if clientMessage.Cmd == UDPAssociate {
+		return s.handleUDPAssociate(ctx, conn, clientMessage, sess, reply)
+	}
+	return s.handleTCPRequest(ctx, conn, clientMessage, sess, out, reply, relay)
+}
+
+// finishSession 在请求结束后写入访问日志
+func (s *SOCKS5Server) finishSession(ctx context.Context, sess *session, err error) {
+	if s.AccessLog == nil {
+		return
+	}
+	reason := closeReason(err)
+	if sess.killed.Load() {
+		reason = "killed"
+	}
+	if werr := s.AccessLog.Write(sess.record(time.Now(), reason)); werr != nil {
+		s.log(ctx).Error("write access log failed", "err", werr)
+	}
+}
+
+// outbound 是规则为请求选择的出站方式
+type outbound struct {
+	// 上游代理链，为空时直连
+	chain []Upstream
+	// 发送给目标的 PROXY 协议头版本，0 表示不发送
+	proxyProtocol int
+	// 规则检查用的请求，未设置规则时为 nil
+	req *Request
+}
+
+// route 检查规则，返回是否放行以及出站方式
+func (s *SOCKS5Server) route(conn net.Conn, clientMessage *ClientRequestMassage, user string) (outbound, bool) {
+	var out outbound
+	if s.Rules == nil {
+		return out, true
+	}
+	req := &Request{
+		ClientRequestMassage: clientMessage,
+		ClientAddr:           conn.RemoteAddr(),
+		User:                 user,
+		Association:          clientMessage.Cmd == UDPAssociate,
+	}
+	if !s.Rules.Allow(req) {
+		return out, false
+	}
+	out.req = req
+	if router, ok := s.Rules.(Router); ok {
+		out.chain = router.Route(req)
+	}
+	if router, ok := s.Rules.(ProxyHeaderRouter); ok {
+		out.proxyProtocol = router.ProxyProtocol(req)
+	}
+	return out, true
+}
+
+// allowResolved 按域名解析得到的 IP 再次检查规则，防止域名绕过按网段拒绝的规则
+func (s *SOCKS5Server) allowResolved(req *Request, ip net.IP) bool {
+	if req == nil {
+		return true
+	}
+	req.ResolvedIP = ip
+	return s.Rules.Allow(req)
+}
+
+func (s *SOCKS5Server) resolver() NameResolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+	return SystemResolver{}
+}
+
+func (s *SOCKS5Server) handleTCPRequest(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, sess *session, out outbound, reply replyFunc, relay relayFunc) error {
+	targetConn, err := s.dialTarget(ctx, conn, clientMessage, out)
+	if err != nil {
+		s.log(ctx).Info("dial failed", "err", err)
+		reply(dialReplyCode(err), nil)
+		return err
+	}
+	s.log(ctx).Debug("connected", "remote", targetConn.RemoteAddr().String())
+	if len(out.chain) == 0 {
+		sess.setResolvedIP(addrIP(targetConn.RemoteAddr()))
+	}
+	//发送成功报文
+	addrSpec := &AddrSpec{}
+	if addr, ok := targetConn.LocalAddr().(*net.TCPAddr); ok {
+		addrSpec.IP = addr.IP
+		addrSpec.Port = addr.Port
+	}
+	err = reply(successReply, addrSpec)
+	if err != nil {
+		targetConn.Close()
+		return err
+	}
+	return relay(ctx, conn, targetConn, sess)
+}
+
+// dialTarget 为 conn 上的请求连接目标，失败时返回的错误可由 dialReplyCode 转为应答码
+func (s *SOCKS5Server) dialTarget(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, out outbound) (net.Conn, error) {
+	//直连时在服务端解析域名，经上游代理时交给上游解析
+	host := clientMessage.Address
+	if clientMessage.AddrType == DomainName && len(out.chain) == 0 {
+		ip, err := s.resolver().Resolve(ctx, host)
+		if err != nil {
+			return nil, &ReplyError{Code: hostUnreachable, Err: err}
+		}
+		if !s.allowResolved(out.req, ip) {
+			return nil, &ReplyError{Code: ruleFailure, Err: ErrRuleFailure}
+		}
+		host = ip.String()
+	}
+	//请求访问目标TCP服务
+	address := net.JoinHostPort(host, strconv.Itoa(int(clientMessage.Port)))
+	start := time.Now()
+	targetConn, err := s.dialChain(ctx, out.chain, address)
+	s.metrics.observeDial(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	//向目标说明真实的客户端地址
+	if out.proxyProtocol != 0 {
+		err = WriteProxyHeader(targetConn, out.proxyProtocol, conn.RemoteAddr(), conn.LocalAddr())
+		if err != nil {
+			targetConn.Close()
+			return nil, err
+		}
+	}
+	return targetConn, nil
+}
+
+// dialReplyCode 将拨号错误映射为应答码
+func dialReplyCode(err error) uint8 {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	msg := err.Error()
+	resp := hostUnreachable
+	if strings.Contains(msg, "refused") {
+		resp = connectionRefused
+	} else if strings.Contains(msg, "network is unreachable") {
+		resp = networkUnreachable
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		resp = ttlExpired
+	}
+	return resp
+}
+
+func (s *SOCKS5Server) handleBind(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, sess *session, reply replyFunc) error {
+	//在控制连接的本地地址上监听
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		reply(serverFailure, nil)
+		return err
+	}
+	defer listener.Close()
+	//服务关闭时停止等待
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	//第一次应答：告知客户端监听地址
+	addr := listener.Addr().(*net.TCPAddr)
+	err = reply(successReply, &AddrSpec{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		return err
+	}
+	timeout := s.BindTimeout
+	if timeout == 0 {
+		timeout = DefaultBindTimeout
+	}
+	listener.SetDeadline(time.Now().Add(timeout))
+	var targetConn *net.TCPConn
+	for {
+		targetConn, err = listener.AcceptTCP()
+		if err != nil {
+			reply(serverFailure, nil)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrBindTimeout
+			}
+			return err
+		}
+		peer := targetConn.RemoteAddr().(*net.TCPAddr)
+		if s.BindCheckAddr && !bindPeerAllowed(clientMessage, peer) {
+			//忽略非预期的对端
+			targetConn.Close()
+			continue
+		}
+		break
+	}
+	//第二次应答：告知客户端对端地址
+	peer := targetConn.RemoteAddr().(*net.TCPAddr)
+	err = reply(successReply, &AddrSpec{IP: peer.IP, Port: peer.Port})
+	if err != nil {
+		targetConn.Close()
+		return err
+	}
+	return s.tcpForward(ctx, conn, targetConn, sess)
+}
+
+func bindPeerAllowed(clientMessage *ClientRequestMassage, peer *net.TCPAddr) bool {
+	ip := net.ParseIP(clientMessage.Address)
+	if ip == nil || ip.IsUnspecified() {
+		//域名或全零地址不做限制
+		return true
+	}
+	return ip.Equal(peer.IP)
+}
+
+// udpAssociation 表示一次 UDP ASSOCIATE，生命周期与控制连接一致
+type udpAssociation struct {
+	relayer *net.UDPConn
+	// 发往 IPv4 和 IPv6 目标的套接字，可能是同一个双栈套接字，也可能其中一个为 nil
+	sender4, sender6 *net.UDPConn
+	clientIP         net.IP
+	// 客户端声明的源端口，为 0 时不限制
+	clientPort int
+	frags      reassemblyQueue
+	resolver   NameResolver
+	metrics    *metrics
+	logger     *slog.Logger
+	session    *session
+	throttle   *Throttle
+	rules      RuleSet
+}
+
+func (s *SOCKS5Server) handleUDPAssociate(ctx context.Context, conn net.Conn, clientMessage *ClientRequestMassage, sess *session, reply replyFunc) error {
+	//在控制连接的本地地址上监听临时端口
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	relayer, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		reply(serverFailure, nil)
+		return err
+	}
+	defer relayer.Close()
+	sender4, sender6, err := s.listenUDPSenders()
+	if err != nil {
+		reply(serverFailure, nil)
+		return err
+	}
+	if sender4 != nil {
+		defer sender4.Close()
+	}
+	if sender6 != nil && sender6 != sender4 {
+		defer sender6.Close()
+	}
+
+	addr := relayer.LocalAddr().(*net.UDPAddr)
+	err = reply(successReply, &AddrSpec{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		return err
+	}
+	//只接受客户端声明的源地址，未声明时使用控制连接的地址
+	assoc := &udpAssociation{
+		relayer:    relayer,
+		sender4:    sender4,
+		sender6:    sender6,
+		clientPort: int(clientMessage.Port),
+		frags:      reassemblyQueue{timeout: s.UDPReassemblyTimeout},
+		resolver:   s.resolver(),
+		metrics:    &s.metrics,
+		logger:     s.log(ctx),
+		session:    sess,
+		throttle:   s.Throttle,
+		rules:      s.Rules,
+	}
+	if ip := net.ParseIP(clientMessage.Address); ip != nil && !ip.IsUnspecified() {
+		assoc.clientIP = ip
+	} else {
+		assoc.clientIP = addrIP(conn.RemoteAddr())
+	}
+	s.metrics.associations.Add(1)
+	defer s.metrics.associations.Add(-1)
+	go assoc.forward(ctx)
+	//控制连接关闭后释放关联
+	io.Copy(io.Discard, conn)
+	return nil
+}
+
+// listenUDPSenders 按地址族打开 UDP 中继的出站套接字，未配置出站地址时
+// 两者为同一个双栈套接字
+func (s *SOCKS5Server) listenUDPSenders() (sender4, sender6 *net.UDPConn, err error) {
+	ip4, err4 := s.outboundIP(false)
+	ip6, err6 := s.outboundIP(true)
+	if ip4 == nil && ip6 == nil && err4 == nil && err6 == nil {
+		sender, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, sender, nil
+	}
+	//出站网卡可能只有一个地址族的地址，有一个可用即可
+	if err4 == nil {
+		if sender4, err4 = net.ListenUDP("udp4", &net.UDPAddr{IP: ip4}); err4 != nil {
+			sender4 = nil
+		}
+	}
+	if err6 == nil {
+		if sender6, err6 = net.ListenUDP("udp6", &net.UDPAddr{IP: ip6}); err6 != nil {
+			sender6 = nil
+		}
+	}
+	if sender4 == nil && sender6 == nil {
+		return nil, nil, err4
+	}
+	return sender4, sender6, nil
+}
+
+func (a *udpAssociation) accept(addr *net.UDPAddr) bool {
+	if a.clientIP != nil && !a.clientIP.Equal(addr.IP) {
+		return false
+	}
+	return a.clientPort == 0 || a.clientPort == addr.Port
+}
+
+func (a *udpAssociation) forward(ctx context.Context) {
+	buf := make([]byte, MaxSegmentSize)
+	var clientAddr *net.UDPAddr
+	for {
+		n, addr, err := a.relayer.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if clientAddr == nil {
+			if !a.accept(addr) {
+				//无视没有协商的客户端
+				continue
+			}
+			clientAddr = addr
+			if a.sender4 != nil {
+				go a.relayToClient(ctx, a.sender4, clientAddr)
+			}
+			if a.sender6 != nil && a.sender6 != a.sender4 {
+				go a.relayToClient(ctx, a.sender6, clientAddr)
+			}
+		} else if !clientAddr.IP.Equal(addr.IP) || clientAddr.Port != addr.Port {
+			continue
+		}
+
+		d, err := NewUDPDatagramFromBytes(buf[0:n])
+		if err != nil {
+			continue
+		}
+		if d = a.frags.push(d); d == nil {
+			continue
+		}
+		if !a.allow(d, nil) {
+			a.logger.Debug("udp datagram denied by rules", "dest", d.Address())
+			continue
+		}
+		if err := a.throttle.wait(ctx, a.session, clientToTarget, len(d.Data)); err != nil {
+			return
+		}
+		err = a.relayToRemote(ctx, d)
+		if err != nil {
+			a.logger.Debug("udp relay failed", "dest", d.Address(), "err", err)
+			continue
+		}
+		a.metrics.udpUp.Add(uint64(len(d.Data)))
+		a.session.in.Add(uint64(len(d.Data)))
+	}
+}
+
+// relayToClient 将目标发来的数据封装后转发给客户端
+func (a *udpAssociation) relayToClient(ctx context.Context, sender *net.UDPConn, clientAddr net.Addr) error {
+	buf := make([]byte, MaxSegmentSize)
+
+	for {
+		n, addr, err := sender.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		bAddr, err := NewAddrByteFromString(addr.String())
+		if err != nil {
+			return err
+		}
+
+		if err := a.throttle.wait(ctx, a.session, targetToClient, n); err != nil {
+			return err
+		}
+		_, err = a.relayer.WriteTo(NewUDPDatagram(bAddr, buf[:n]).ToBytes(), clientAddr)
+		if err != nil {
+			return err
+		}
+		a.metrics.udpDown.Add(uint64(n))
+		a.session.out.Add(uint64(n))
+	}
+}
+
+// allow 按数据报的目标检查规则，ip 为域名目标解析得到的 IP
+func (a *udpAssociation) allow(d *UDPDatagram, ip net.IP) bool {
+	if a.rules == nil {
+		return true
+	}
+	clientMessage := &ClientRequestMassage{
+		Cmd:      UDPAssociate,
+		AddrType: d.AType,
+		Address:  net.IP(d.DstAddr).String(),
+		Port:     binary.BigEndian.Uint16(d.DstPort),
+	}
+	if d.AType == DomainName {
+		clientMessage.Address = string(d.DstAddr[1:])
+	}
+	return a.rules.Allow(&Request{
+		ClientRequestMassage: clientMessage,
+		ClientAddr:           a.session.client,
+		User:                 a.session.user,
+		ResolvedIP:           ip,
+	})
+}
+
+func (a *udpAssociation) relayToRemote(ctx context.Context, d *UDPDatagram) error {
+	tgtUDPAddr := &net.UDPAddr{
+		IP:   net.IP(d.DstAddr),
+		Port: int(binary.BigEndian.Uint16(d.DstPort)),
+	}
+	if d.AType == DomainName {
+		ctx, cancel := context.WithTimeout(ctx, udpResolveTimeout)
+		defer cancel()
+		ip, err := a.resolver.Resolve(ctx, string(d.DstAddr[1:]))
+		if err != nil {
+			return err
+		}
+		if !a.allow(d, ip) {
+			return ErrRuleFailure
+		}
+		tgtUDPAddr.IP = ip
+	}
+
+	sender := a.sender4
+	if tgtUDPAddr.IP.To4() == nil {
+		sender = a.sender6
+	}
+	if sender == nil {
+		return fmt.Errorf("no outbound address for %v", tgtUDPAddr.IP)
+	}
+	_, err := sender.WriteTo(d.Data, tgtUDPAddr)
+	return err
+}
+
+func parseFrame(buffer []byte, atyp byte) (net.IP, uint16, []byte, error) {
+	var dstAddr net.IP
+	var dstPort uint16
+	var data []byte
+
+	switch atyp {
+	case 0x01: // IPv4
+		if len(buffer) < 7 {
+			return nil, 0, nil, fmt.Errorf("无效的IPv4帧长度")
+		}
+		dstAddr = net.IPv4(buffer[0], buffer[1], buffer[2], buffer[3])
+		dstPort = binary.BigEndian.Uint16(buffer[4:6])
+		data = buffer[6:]
+	case 0x03: // 域名
+		domainLen := int(buffer[0])
+		if len(buffer) < 2+domainLen+2 {
+			return nil, 0, nil, fmt.Errorf("无效的域名帧长度")
+		}
+		dstAddr = net.IP(buffer[1 : 1+domainLen])
+		dstPort = binary.BigEndian.Uint16(buffer[1+domainLen : 1+domainLen+2])
+		data = buffer[1+domainLen+2:]
+	case 0x04: // IPv6
+		if len(buffer) < 19 {
+			return nil, 0, nil, fmt.Errorf("无效的IPv6帧长度")
+		}
+		dstAddr = net.IP(buffer[0:16])
+		dstPort = binary.BigEndian.Uint16(buffer[16:18])
+		data = buffer[18:]
+	default:
+		return nil, 0, nil, fmt.Errorf("不支持的地址类型: %d", atyp)
+	}
+
+	return dstAddr, dstPort, data, nil
+}
+
+func buildFrame(dstAddr net.IP, dstPort uint16, data []byte) []byte {
+	var frame []byte
+	frame = append(frame, 0x00, 0x00) // RSV
+	frame = append(frame, 0x00)       // FRAG
+
+	if dstAddr.To4() != nil {
+		frame = append(frame, 0x01) // ATYP (IPv4)
+		frame = append(frame, dstAddr.To4()...)
+	} else if dstAddr.To16() != nil {
+		frame = append(frame, 0x04) // ATYP (IPv6)
+		frame = append(frame, dstAddr.To16()...)
+	} else {
+		// 不支持的地址类型
+		return nil
+	}
+
+	frame = append(frame, byte(dstPort>>8), byte(dstPort&0xff)) // DST.PORT
+	frame = append(frame, data...)                              // DATA
+
+	return frame
+}
+
+func (s *SOCKS5Server) tcpForward(ctx context.Context, conn net.Conn, targetConn net.Conn, sess *session) error {
+	defer targetConn.Close()
+	s.metrics.tunnels.Add(1)
+	defer s.metrics.tunnels.Add(-1)
+	go func() {
+		up := s.throttled(ctx, countingWriter{targetConn, &s.metrics.tcpUp, &sess.in}, sess, clientToTarget)
+		_, err := io.Copy(up, conn)
+		if cw, ok := targetConn.(interface{ CloseWrite() error }); ok && err == nil {
+			//客户端半关闭，继续等待目标的响应
+			cw.CloseWrite()
+			return
+		}
+		targetConn.Close()
+	}()
+	down := s.throttled(ctx, countingWriter{conn, &s.metrics.tcpDown, &sess.out}, sess, targetToClient)
+	_, err := io.Copy(down, targetConn)
+	return err
+}
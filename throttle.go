@@ -0,0 +1,245 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 限速写入时每次最多申请的字节数，使数据均匀发送
+const throttleChunk = 4096
+
+// 转发方向
+const (
+	clientToTarget = iota
+	targetToClient
+)
+
+// Bandwidth 是两个方向上的限速，单位为字节/秒，0 表示不限制
+type Bandwidth struct {
+	// 客户端发往目标
+	Up int64
+	// 目标发往客户端
+	Down int64
+}
+
+// Throttle 对 TCP 隧道和 UDP 中继转发的数据限速。全局、每个用户和每个客户端网段
+// 各有一组令牌桶，同一用户或网段的所有会话共享令牌桶，命中多组时需同时满足。
+// Set 系列方法可在运行时调用，立即作用于已有会话
+type Throttle struct {
+	mu       sync.Mutex
+	global   *bucketPair
+	users    map[string]*bucketPair
+	networks []networkBuckets
+}
+
+type networkBuckets struct {
+	network *net.IPNet
+	buckets *bucketPair
+}
+
+type bucketPair [2]*tokenBucket
+
+func newBucketPair(bw Bandwidth) *bucketPair {
+	return &bucketPair{newTokenBucket(bw.Up), newTokenBucket(bw.Down)}
+}
+
+func (p *bucketPair) set(bw Bandwidth) {
+	p[clientToTarget].setRate(bw.Up)
+	p[targetToClient].setRate(bw.Down)
+}
+
+// SetGlobal 设置所有会话共享的限速
+func (t *Throttle) SetGlobal(bw Bandwidth) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.global == nil {
+		t.global = newBucketPair(bw)
+		return
+	}
+	t.global.set(bw)
+}
+
+// SetUser 设置认证用户 user 的限速，bw 为零值时取消限制
+func (t *Throttle) SetUser(user string, bw Bandwidth) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.users[user]; ok {
+		p.set(bw)
+		return
+	}
+	if bw == (Bandwidth{}) {
+		return
+	}
+	if t.users == nil {
+		t.users = make(map[string]*bucketPair)
+	}
+	t.users[user] = newBucketPair(bw)
+}
+
+// SetNetwork 设置来自 network 的客户端的限速，bw 为零值时取消限制
+func (t *Throttle) SetNetwork(network *net.IPNet, bw Bandwidth) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.networks {
+		if n.network.String() == network.String() {
+			n.buckets.set(bw)
+			return
+		}
+	}
+	if bw == (Bandwidth{}) {
+		return
+	}
+	t.networks = append(t.networks, networkBuckets{network: network, buckets: newBucketPair(bw)})
+}
+
+// buckets 返回会话在 dir 方向上需要满足的令牌桶
+func (t *Throttle) buckets(user string, ip net.IP, dir int) []*tokenBucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buckets []*tokenBucket
+	if t.global != nil {
+		buckets = append(buckets, t.global[dir])
+	}
+	if p, ok := t.users[user]; ok && user != "" {
+		buckets = append(buckets, p[dir])
+	}
+	for _, n := range t.networks {
+		if ip != nil && n.network.Contains(ip) {
+			buckets = append(buckets, n.buckets[dir])
+		}
+	}
+	return buckets
+}
+
+// wait 等待可以发送 n 字节，t 为 nil 时不限制
+func (t *Throttle) wait(ctx context.Context, sess *session, dir int, n int) error {
+	if t == nil {
+		return nil
+	}
+	for _, b := range t.buckets(sess.user, addrIP(sess.client), dir) {
+		if err := b.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttledWriter 按会话的限速写入
+type throttledWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	throttle *Throttle
+	sess     *session
+	dir      int
+}
+
+func (w throttledWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if err := w.throttle.wait(w.ctx, w.sess, w.dir, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// throttled 在设置了 Throttle 时为 w 加上限速
+func (s *SOCKS5Server) throttled(ctx context.Context, w io.Writer, sess *session, dir int) io.Writer {
+	if s.Throttle == nil {
+		return w
+	}
+	return throttledWriter{ctx: ctx, w: w, throttle: s.Throttle, sess: sess, dir: dir}
+}
+
+// tokenBucket 是容量为一秒流量的令牌桶，令牌可以透支，透支部分按速率等待补足
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// 速率变化时关闭，通知等待者重新计算
+	changed chan struct{}
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:    float64(rate),
+		tokens:  float64(rate),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.rate <= 0 {
+		//从不限制变为限制时以满桶开始
+		b.tokens = float64(rate)
+	}
+	b.rate = float64(rate)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// refill 按经过的时间补充令牌，需持有 mu
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// delay 返回透支的令牌补足还需的时间，需持有 mu
+func (b *tokenBucket) delay() time.Duration {
+	if b.rate <= 0 || b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	b.refill(time.Now())
+	if b.rate > 0 {
+		b.tokens -= float64(n)
+	}
+	d, changed := b.delay(), b.changed
+	b.mu.Unlock()
+
+	for d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-changed:
+			timer.Stop()
+			//速率已调整，按新速率重新计算等待时间
+			b.mu.Lock()
+			b.refill(time.Now())
+			d, changed = b.delay(), b.changed
+			b.mu.Unlock()
+		}
+	}
+	return nil
+}
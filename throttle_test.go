@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10000)
+	start := time.Now()
+	b.wait(context.Background(), 10000)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("wait within burst took %v", d)
+	}
+	b.wait(context.Background(), 2000)
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("wait beyond burst took %v, want about 200ms", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.wait(ctx, 10000); err != context.DeadlineExceeded {
+		t.Errorf("wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestTokenBucketRateChange(t *testing.T) {
+	b := newTokenBucket(1000)
+	b.wait(context.Background(), 1000)
+	done := make(chan struct{})
+	go func() {
+		b.wait(context.Background(), 4000)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.setRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after the limit was removed")
+	}
+}
+
+func TestThrottleBuckets(t *testing.T) {
+	th := &Throttle{}
+	th.SetGlobal(Bandwidth{Up: 1000})
+	th.SetUser("alice", Bandwidth{Down: 1000})
+	th.SetNetwork(mustCIDR("10.0.0.0/8"), Bandwidth{Up: 1000, Down: 1000})
+	th.SetUser("carol", Bandwidth{})
+
+	tests := []struct {
+		user string
+		ip   net.IP
+		want int
+	}{
+		{"alice", net.IPv4(10, 1, 1, 1), 3},
+		{"alice", net.IPv4(192, 168, 1, 1), 2},
+		{"bob", net.IPv4(10, 1, 1, 1), 2},
+		{"carol", nil, 1},
+		{"", nil, 1},
+	}
+	for _, tt := range tests {
+		if got := len(th.buckets(tt.user, tt.ip, clientToTarget)); got != tt.want {
+			t.Errorf("buckets(%q, %v) = %d, want %d", tt.user, tt.ip, got, tt.want)
+		}
+	}
+}
+
+// echoThrough 经 conn 发送 n 字节并读回，返回耗时
+func echoThrough(t *testing.T, conn net.Conn, n int) time.Duration {
+	t.Helper()
+	data := bytes.Repeat([]byte("x"), n)
+	start := time.Now()
+	go conn.Write(data)
+	got := make([]byte, n)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	return time.Since(start)
+}
+
+func TestThrottleTunnel(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Throttle: &Throttle{}}
+	s.Throttle.SetGlobal(Bandwidth{Down: 100000})
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn := connectTunnel(t, addr, echo.Addr().(*net.TCPAddr))
+	defer conn.Close()
+	if d := echoThrough(t, conn, 150000); d < 400*time.Millisecond {
+		t.Errorf("150000 bytes at 100000 B/s took %v, want about 500ms", d)
+	}
+}
+
+func TestThrottleAdjustAtRuntime(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Credentials: StaticCredentials{"alice": "a"}, Throttle: &Throttle{}}
+	s.Throttle.SetUser("alice", Bandwidth{Down: 4000})
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	conn, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "a"}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//不调整时约需 4 秒
+	time.AfterFunc(200*time.Millisecond, func() { s.Throttle.SetUser("alice", Bandwidth{}) })
+	if d := echoThrough(t, conn, 20000); d > 2*time.Second {
+		t.Errorf("transfer took %v after the limit was lifted", d)
+	}
+}
@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientCA         = errors.New("no certificates found in client CA file")
+	ErrTLSNotConfigured = errors.New("socks5: TLS not configured")
+)
+
+// TLSConfig 配置 SOCKS5 over TLS 监听
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// 非空时要求客户端证书并用该 CA 校验，证书 CommonName 作为用户身份
+	ClientCAFile string
+	// 检查证书文件变化的间隔，为 0 时不重新加载
+	ReloadInterval time.Duration
+}
+
+// certReloader 在证书文件变化后重新加载
+type certReloader struct {
+	cfg       *TLSConfig
+	logger    *slog.Logger
+	mu        sync.Mutex
+	checked   time.Time
+	modTime   time.Time
+	tlsConfig *tls.Config
+}
+
+func newCertReloader(cfg *TLSConfig, logger *slog.Logger) (*certReloader, error) {
+	r := &certReloader{cfg: cfg, logger: logger, checked: time.Now()}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	modTime := r.latestModTime()
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrClientCA
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.tlsConfig = config
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.ReloadInterval > 0 && time.Since(r.checked) >= r.cfg.ReloadInterval {
+		r.checked = time.Now()
+		if r.latestModTime().After(r.modTime) {
+			//加载失败时继续使用旧证书
+			if err := r.load(); err != nil {
+				r.logger.Error("reload certificate failed", "err", err)
+			}
+		}
+	}
+	return r.tlsConfig, nil
+}
+
+// tlsListener 用 s.TLS 的配置包装 l
+func (s *SOCKS5Server) tlsListener(l net.Listener) (net.Listener, error) {
+	if s.TLS == nil {
+		return nil, ErrTLSNotConfigured
+	}
+	r, err := newCertReloader(s.TLS, s.logger())
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{GetConfigForClient: r.getConfig}), nil
+}
+
+// tlsIdentity 返回已握手连接的客户端证书 CommonName
+func tlsIdentity(conn *tls.Conn) string {
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0].Subject.CommonName
+	}
+	return ""
+}
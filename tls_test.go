@@ -0,0 +1,191 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue 签发证书，返回 PEM 编码的证书和私钥
+func (ca *testCA) issue(t *testing.T, cn string, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startTLSServer(t *testing.T, s *SOCKS5Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := s.tlsListener(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tl)
+	return l.Addr().String()
+}
+
+func tlsClient(addr string, config *tls.Config) *Client {
+	return &Client{
+		ProxyAddr: addr,
+		Forward: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := &tls.Dialer{Config: config}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "proxy", 2)
+	aliceCert, aliceKey := ca.issue(t, "alice", 3)
+	bobCert, bobKey := ca.issue(t, "bob", 4)
+	writeFile(t, filepath.Join(dir, "server.pem"), serverCert)
+	writeFile(t, filepath.Join(dir, "server.key"), serverKey)
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem)
+
+	s := &SOCKS5Server{
+		TLS: &TLSConfig{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+		Rules: Rules{{Action: RuleAllow, Users: []string{"alice"}}},
+	}
+	addr := startTLSServer(t, s)
+	defer s.Close()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+
+	alice, _ := tls.X509KeyPair(aliceCert, aliceKey)
+	conn, err := tlsClient(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}}).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() as alice error = %v", err)
+	}
+	echoRoundTrip(t, conn)
+	conn.Close()
+
+	bob, _ := tls.X509KeyPair(bobCert, bobKey)
+	_, err = tlsClient(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{bob}}).Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Error("Dial() as bob succeeded, want rule failure")
+	}
+	_, err = tlsClient(addr, &tls.Config{RootCAs: roots}).Dial("tcp", echo.Addr().String())
+	if err == nil {
+		t.Error("Dial() without client certificate succeeded")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	cert, key := ca.issue(t, "old", 2)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+
+	s := &SOCKS5Server{TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadInterval: time.Millisecond}}
+	addr := startTLSServer(t, s)
+	defer s.Close()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("tls.Dial() error = %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if cn := serverName(); cn != "old" {
+		t.Fatalf("certificate = %s, want old", cn)
+	}
+	cert, key = ca.issue(t, "new", 3)
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(5 * time.Millisecond)
+	if cn := serverName(); cn != "new" {
+		t.Errorf("certificate after reload = %s, want new", cn)
+	}
+}
+
+func TestServeTLSNotConfigured(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SOCKS5Server{}
+	if err := s.ServeTLS(l); err != ErrTLSNotConfigured {
+		t.Errorf("ServeTLS() error = %v, want %v", err, ErrTLSNotConfigured)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener not closed")
+	}
+}
@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var (
+	ErrNotRedirected          = errors.New("connection was not redirected to the proxy")
+	ErrTransparentUnsupported = errors.New("transparent proxy is not supported on this platform")
+)
+
+// ServeTransparent 在 l 上接受由 iptables REDIRECT 或 TPROXY 转来的连接，
+// 不进行 SOCKS 握手，直接按原始目的地址经规则、拨号器和上游代理链转发。
+// TPROXY 需要使用 ListenTransparent 创建的监听
+func (s *SOCKS5Server) ServeTransparent(l net.Listener) error {
+	if len(s.ProxyProtocolTrusted) > 0 {
+		l = &proxyProtoListener{Listener: l, trusted: s.ProxyProtocolTrusted}
+	}
+	laddr, _ := l.Addr().(*net.TCPAddr)
+	return s.serve(context.Background(), l, func(ctx context.Context, conn net.Conn) error {
+		return s.handleTransparent(ctx, conn, laddr)
+	})
+}
+
+// handleTransparent 处理监听 laddr 上接受的连接
+func (s *SOCKS5Server) handleTransparent(ctx context.Context, conn net.Conn, laddr *net.TCPAddr) error {
+	dst, err := originalDst(conn)
+	if err != nil {
+		return err
+	}
+	//直接连到代理的连接，原始目的地址就是代理自身，转发会形成环路
+	if laddr != nil && loopsBack(dst, laddr) {
+		return ErrNotRedirected
+	}
+	return s.serveTransparent(ctx, conn, dst)
+}
+
+// loopsBack 判断连接 dst 是否会回到监听 laddr
+func loopsBack(dst, laddr *net.TCPAddr) bool {
+	if dst.Port != laddr.Port {
+		return false
+	}
+	if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		return dst.IP.Equal(laddr.IP)
+	}
+	//监听全部地址时，本机的任一地址都会回到代理
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTransparent 将 conn 转发到 dst，规则中的用户为空
+func (s *SOCKS5Server) serveTransparent(ctx context.Context, conn net.Conn, dst *net.TCPAddr) error {
+	clientMessage, err := NewClientRequestMassageFromAddress(Connect, dst.String())
+	if err != nil {
+		return err
+	}
+	//透明代理没有应答报文
+	reply := func(rep uint8, addr *AddrSpec) error {
+		return nil
+	}
+	return s.serveRequest(ctx, conn, clientMessage, "", reply)
+}
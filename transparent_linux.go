@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// netfilter 中取原始目的地址的 socket 选项
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+	// syscall 包中没有定义 IPV6_TRANSPARENT
+	ipv6Transparent = 75
+)
+
+// ListenTransparent 创建设置了 IP_TRANSPARENT 的 TCP 监听，用于 iptables TPROXY，
+// 需要 CAP_NET_ADMIN 权限
+func ListenTransparent(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+					return
+				}
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// originalDst 返回连接的原始目的地址：TPROXY 连接的本地地址即原始目的地址，
+// REDIRECT 连接从 SO_ORIGINAL_DST 读取
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	if c, ok := conn.(*proxyProtoConn); ok {
+		conn = c.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNotRedirected
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var transparent bool
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		transparent = isTransparent(int(fd))
+		if transparent {
+			return
+		}
+		dst, serr = getOriginalDst(int(fd), local.IP.To4() == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if transparent {
+		return local, nil
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return dst, nil
+}
+
+// isTransparent 判断连接是否来自 IP_TRANSPARENT 监听，accept 得到的连接会继承该选项
+func isTransparent(fd int) bool {
+	if v, err := syscall.GetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT); err == nil && v != 0 {
+		return true
+	}
+	v, err := syscall.GetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent)
+	return err == nil && v != 0
+}
+
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	level, opt := syscall.SOL_IP, soOriginalDst
+	if ipv6 {
+		level, opt = syscall.SOL_IPV6, ip6tSoOriginalDst
+	}
+	//缓冲区按 sockaddr_in6 的大小分配，足以容纳 sockaddr_in
+	var buf [syscall.SizeofSockaddrInet6]byte
+	size := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	//sin_port 为网络字节序
+	port := int(binary.BigEndian.Uint16(buf[2:4]))
+	if ipv6 {
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, buf[8:24]...)), Port: port}, nil
+	}
+	return &net.TCPAddr{IP: net.IPv4(buf[4], buf[5], buf[6], buf[7]), Port: port}, nil
+}
@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	s := &SOCKS5Server{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTransparent(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//没有 REDIRECT 规则时不能把连接转发回代理自身
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Read() = %v, %v, want connection closed", n, err)
+	}
+}
+
+func TestListenTransparent(t *testing.T) {
+	l, err := ListenTransparent("tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("IP_TRANSPARENT needs CAP_NET_ADMIN: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//TPROXY 连接的原始目的地址就是本地地址
+	dst, err := originalDst(conn)
+	if err != nil {
+		t.Fatalf("originalDst() error = %v", err)
+	}
+	if dst.String() != conn.LocalAddr().String() {
+		t.Errorf("originalDst() = %v, want %v", dst, conn.LocalAddr())
+	}
+}
+
+func TestServeTransparentTPROXYNotRedirected(t *testing.T) {
+	l, err := ListenTransparent("tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("IP_TRANSPARENT needs CAP_NET_ADMIN: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SOCKS5Server{}
+	go s.ServeTransparent(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//TPROXY 监听上直接连入的连接本地地址就是代理自身，不能转发
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil || os.IsTimeout(err) {
+		t.Errorf("Read() = %v, %v, want connection closed", n, err)
+	}
+}
+
+// TestOriginalDstRedirect 在独立的网络命名空间中添加 REDIRECT 规则，
+// 检查从 SO_ORIGINAL_DST 读到的原始目的地址
+func TestOriginalDstRedirect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	iptables, err := exec.LookPath("iptables")
+	if err != nil {
+		t.Skip("iptables not found")
+	}
+	ip, err := exec.LookPath("ip")
+	if err != nil {
+		t.Skip("ip not found")
+	}
+	//命名空间只对当前线程生效，测试结束后锁定的线程随 goroutine 退出而销毁
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare network namespace: %v", err)
+	}
+	if out, err := exec.Command(ip, "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Fatalf("ip link set lo up: %v: %s", err, out)
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	out, err := exec.Command(iptables, "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "127.0.0.2",
+		"--dport", "9", "-j", "REDIRECT", "--to-ports", port).CombinedOutput()
+	if err != nil {
+		t.Skipf("add REDIRECT rule: %v: %s", err, out)
+	}
+
+	client, err := net.Dial("tcp4", "127.0.0.2:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dst, err := originalDst(conn)
+	if err != nil {
+		t.Fatalf("originalDst() error = %v", err)
+	}
+	if dst.String() != "127.0.0.2:9" {
+		t.Errorf("originalDst() = %v, want 127.0.0.2:9", dst)
+	}
+}
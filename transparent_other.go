@@ -0,0 +1,14 @@
+//go:build !linux
+
+package socks5
+
+import "net"
+
+// ListenTransparent 只在 Linux 上可用
+func ListenTransparent(network, address string) (net.Listener, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentUnsupported
+}
@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// serveTransparentOne 在本地监听，把第一个连接当作去往 dst 的透明代理连接处理
+func serveTransparentOne(t *testing.T, s *SOCKS5Server, dst *net.TCPAddr) (string, <-chan error) {
+	t.Helper()
+	return serveOne(t, func(ctx context.Context, conn net.Conn) error {
+		return s.serveTransparent(ctx, conn, dst)
+	})
+}
+
+func TestServeTransparent(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	addr, _ := serveTransparentOne(t, &SOCKS5Server{}, echo.Addr().(*net.TCPAddr))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn)
+}
+
+func TestServeTransparentRuleFailure(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleDeny, Ports: []PortRange{{From: 1, To: 65535}}}}}
+	addr, errCh := serveTransparentOne(t, s, echo.Addr().(*net.TCPAddr))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-errCh; err != ErrRuleFailure {
+		t.Errorf("serveTransparent() error = %v, want %v", err, ErrRuleFailure)
+	}
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("Read() = %v, %v, want connection closed", n, err)
+	}
+}
+
+func TestLoopsBack(t *testing.T) {
+	tests := []struct {
+		name  string
+		dst   string
+		laddr string
+		want  bool
+	}{
+		{"Listener address", "127.0.0.1:1080", "127.0.0.1:1080", true},
+		{"Other port", "127.0.0.1:80", "127.0.0.1:1080", false},
+		{"Other address", "10.0.0.1:1080", "127.0.0.1:1080", false},
+		{"Loopback on wildcard listener", "127.0.0.2:1080", "0.0.0.0:1080", true},
+		{"Remote on wildcard listener", "192.0.2.1:1080", "[::]:1080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, _ := net.ResolveTCPAddr("tcp", tt.dst)
+			laddr, _ := net.ResolveTCPAddr("tcp", tt.laddr)
+			if got := loopsBack(dst, laddr); got != tt.want {
+				t.Errorf("loopsBack(%v, %v) = %v, want %v", dst, laddr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// udpEcho 启动一个回显 UDP 服务
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxSegmentSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+// udpAssociate 完成握手并返回服务端的中继地址
+func udpAssociate(t *testing.T, conn net.Conn, src *net.UDPAddr) *net.UDPAddr {
+	t.Helper()
+	req := []byte{SOCKS5Version, UDPAssociate, 0x00, IPv4}
+	req = append(req, src.IP.To4()...)
+	req = append(req, byte(src.Port>>8), byte(src.Port))
+	conn.Write([]byte{SOCKS5Version, 1, NoAuth})
+	conn.Write(req)
+	io.ReadFull(conn, make([]byte, 2))
+	rep, addr := readReply(t, conn)
+	if rep != successReply {
+		t.Fatalf("reply = %v, want %v", rep, successReply)
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	addr, errCh := serveOne(t, (&SOCKS5Server{}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	relayAddr := udpAssociate(t, conn, udpConn.LocalAddr().(*net.UDPAddr))
+	if relayAddr.Port == 0 {
+		t.Fatal("relay port is 0")
+	}
+
+	bAddr, _ := NewAddrByteFromString(echo.LocalAddr().String())
+	udpConn.WriteTo(NewUDPDatagram(bAddr, []byte("ping")).ToBytes(), relayAddr)
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MaxSegmentSize)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("read relayed datagram: %v", err)
+	}
+	d, err := NewUDPDatagramFromBytes(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Data) != "ping" || d.Address() != echo.LocalAddr().String() {
+		t.Errorf("got %q from %v", d.Data, d.Address())
+	}
+
+	//关闭控制连接后关联应被释放
+	conn.Close()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("association not torn down after control connection closed")
+	}
+	if _, err := net.ListenUDP("udp", relayAddr); err != nil {
+		t.Errorf("relay port still in use: %v", err)
+	}
+}
+
+func TestUDPAssociateRejectsOtherSource(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	addr, _ := serveOne(t, (&SOCKS5Server{}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	declared, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer declared.Close()
+	other, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer other.Close()
+
+	relayAddr := udpAssociate(t, conn, declared.LocalAddr().(*net.UDPAddr))
+	bAddr, _ := NewAddrByteFromString(echo.LocalAddr().String())
+	other.WriteTo(NewUDPDatagram(bAddr, []byte("ping")).ToBytes(), relayAddr)
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := other.Read(make([]byte, MaxSegmentSize)); err == nil {
+		t.Error("datagram from undeclared source was relayed")
+	}
+}
+
+func TestUDPAssociateRules(t *testing.T) {
+	allowed := udpEcho(t)
+	defer allowed.Close()
+	denied := udpEcho(t)
+	defer denied.Close()
+	deniedPort := uint16(denied.LocalAddr().(*net.UDPAddr).Port)
+
+	s := &SOCKS5Server{
+		Resolver: staticResolver{"denied.test": net.IPv4(127, 0, 0, 1)},
+		Rules: Rules{
+			{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("127.0.0.0/8")}, Ports: []PortRange{{From: deniedPort, To: deniedPort}}},
+			{Action: RuleAllow},
+		},
+	}
+	addr, _ := serveOne(t, s.handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	relayAddr := udpAssociate(t, conn, udpConn.LocalAddr().(*net.UDPAddr))
+
+	//发往被拒绝目标的数据报应被丢弃，包括解析到被拒绝网段的域名
+	for _, dest := range []string{denied.LocalAddr().String(), net.JoinHostPort("denied.test", strconv.Itoa(int(deniedPort))), allowed.LocalAddr().String()} {
+		bAddr, _ := NewAddrByteFromString(dest)
+		udpConn.WriteTo(NewUDPDatagram(bAddr, []byte(dest)).ToBytes(), relayAddr)
+	}
+	buf := make([]byte, MaxSegmentSize)
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("read relayed datagram: %v", err)
+	}
+	d, err := NewUDPDatagramFromBytes(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address() != allowed.LocalAddr().String() {
+		t.Errorf("got reply from %v, want only %v", d.Address(), allowed.LocalAddr())
+	}
+	udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := udpConn.Read(buf); err == nil {
+		t.Errorf("unexpected datagram %q", buf[:n])
+	}
+}
+
+// blockingResolver 阻塞到 ctx 结束，并报告 ctx 是否带有截止时间
+type blockingResolver struct {
+	called   chan bool
+	canceled chan struct{}
+}
+
+func (r blockingResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	_, ok := ctx.Deadline()
+	r.called <- ok
+	<-ctx.Done()
+	close(r.canceled)
+	return nil, ctx.Err()
+}
+
+func TestUDPAssociateResolveCanceled(t *testing.T) {
+	resolver := blockingResolver{called: make(chan bool, 1), canceled: make(chan struct{})}
+	addr, _ := serveOne(t, (&SOCKS5Server{Resolver: resolver}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	relayAddr := udpAssociate(t, conn, udpConn.LocalAddr().(*net.UDPAddr))
+
+	bAddr, _ := NewAddrByteFromString("slow.test:53")
+	udpConn.WriteTo(NewUDPDatagram(bAddr, []byte("ping")).ToBytes(), relayAddr)
+	select {
+	case hasDeadline := <-resolver.called:
+		if !hasDeadline {
+			t.Error("resolve context has no deadline")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resolver not called")
+	}
+	//关闭控制连接后应取消正在进行的解析
+	conn.Close()
+	select {
+	case <-resolver.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("resolve not canceled after control connection closed")
+	}
+}
+
+// udpWhoami 启动一个 UDP 服务，回复请求的源地址
+func udpWhoami(t *testing.T, network string, ip net.IP) *net.UDPConn {
+	t.Helper()
+	c, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("listen %v: %v", ip, err)
+	}
+	go func() {
+		buf := make([]byte, MaxSegmentSize)
+		for {
+			_, addr, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo([]byte(addr.IP.String()), addr)
+		}
+	}()
+	return c
+}
+
+func TestUDPAssociateOutboundIP(t *testing.T) {
+	outbound := net.IPv4(127, 0, 0, 2)
+	target4 := udpWhoami(t, "udp4", net.IPv4(127, 0, 0, 1))
+	defer target4.Close()
+	target6 := udpWhoami(t, "udp6", net.IPv6loopback)
+	defer target6.Close()
+	if c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: outbound}); err != nil {
+		t.Skipf("cannot bind %v: %v", outbound, err)
+	} else {
+		c.Close()
+	}
+
+	addr, _ := serveOne(t, (&SOCKS5Server{OutboundIP: outbound}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	relayAddr := udpAssociate(t, conn, udpConn.LocalAddr().(*net.UDPAddr))
+
+	//IPv4 目标使用 OutboundIP，IPv6 目标不绑定
+	want := map[string]string{
+		target4.LocalAddr().String(): outbound.String(),
+		target6.LocalAddr().String(): net.IPv6loopback.String(),
+	}
+	for dest := range want {
+		bAddr, _ := NewAddrByteFromString(dest)
+		udpConn.WriteTo(NewUDPDatagram(bAddr, []byte("who")).ToBytes(), relayAddr)
+	}
+	buf := make([]byte, MaxSegmentSize)
+	for range want {
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			t.Fatalf("read relayed datagram: %v", err)
+		}
+		d, err := NewUDPDatagramFromBytes(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(d.Data); got != want[d.Address()] {
+			t.Errorf("%v saw source %v, want %v", d.Address(), got, want[d.Address()])
+		}
+	}
+}
+
+func fragment(frag byte, data string) *UDPDatagram {
+	bAddr, _ := NewAddrByteFromString("127.0.0.1:9999")
+	d := NewUDPDatagram(bAddr, []byte(data))
+	d.Frag = frag
+	return d
+}
+
+func TestUDPAssociateFragments(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	addr, _ := serveOne(t, (&SOCKS5Server{}).handleConnection)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	relayAddr := udpAssociate(t, conn, udpConn.LocalAddr().(*net.UDPAddr))
+
+	bAddr, _ := NewAddrByteFromString(echo.LocalAddr().String())
+	send := func(frag byte, data string) {
+		d := NewUDPDatagram(bAddr, []byte(data))
+		d.Frag = frag
+		udpConn.WriteTo(d.ToBytes(), relayAddr)
+	}
+	//乱序的序列被丢弃，随后完整的序列重组为一个数据报
+	send(1, "lost")
+	send(3, "lost")
+	send(0x82, "lost")
+	send(1, "hel")
+	send(2, "lo, ")
+	send(0x83, "world")
+
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MaxSegmentSize)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("read relayed datagram: %v", err)
+	}
+	d, err := NewUDPDatagramFromBytes(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Data) != "hello, world" {
+		t.Errorf("got %q, want reassembled %q", d.Data, "hello, world")
+	}
+}
+
+func TestNewUDPDatagramFromBytesFrag(t *testing.T) {
+	d, err := NewUDPDatagramFromBytes([]byte{0, 0, 0x81, IPv4, 127, 0, 0, 1, 0, 53, 'x'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Frag != 0x81 {
+		t.Errorf("Frag = %#x, want 0x81", d.Frag)
+	}
+}
+
+func TestReassemblyQueue(t *testing.T) {
+	tests := []struct {
+		name  string
+		frags []*UDPDatagram
+		want  string
+	}{
+		{
+			name:  "Standalone",
+			frags: []*UDPDatagram{fragment(0, "abc")},
+			want:  "abc",
+		},
+		{
+			name:  "In order",
+			frags: []*UDPDatagram{fragment(1, "ab"), fragment(2, "cd"), fragment(3|fragEnd, "ef")},
+			want:  "abcdef",
+		},
+		{
+			name:  "Restart abandons previous sequence",
+			frags: []*UDPDatagram{fragment(1, "ab"), fragment(2, "cd"), fragment(1, "xy"), fragment(2|fragEnd, "z")},
+			want:  "xyz",
+		},
+		{
+			name:  "Missing fragment",
+			frags: []*UDPDatagram{fragment(1, "ab"), fragment(3|fragEnd, "ef")},
+		},
+		{
+			name:  "Standalone abandons sequence",
+			frags: []*UDPDatagram{fragment(1, "ab"), fragment(0, "x"), fragment(2|fragEnd, "cd")},
+			want:  "x",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &reassemblyQueue{}
+			var got string
+			for _, d := range tt.frags {
+				if r := q.push(d); r != nil {
+					got = string(r.Data)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("push() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReassemblyQueueTimeout(t *testing.T) {
+	q := &reassemblyQueue{timeout: 10 * time.Millisecond}
+	q.push(fragment(1, "ab"))
+	time.Sleep(20 * time.Millisecond)
+	if r := q.push(fragment(2|fragEnd, "cd")); r != nil {
+		t.Errorf("push() after timeout = %q, want nil", r.Data)
+	}
+}
+
+func TestUDPAssociateDestinationRules(t *testing.T) {
+	allowed := udpEcho(t)
+	defer allowed.Close()
+	denied := udpEcho(t)
+	defer denied.Close()
+	port := uint16(allowed.LocalAddr().(*net.UDPAddr).Port)
+
+	//关联请求中的地址是客户端自己的地址，不能按目标端口拒绝
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleAllow, Ports: []PortRange{{From: port, To: port}}}}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	pc, err := (&Client{ProxyAddr: addr}).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer pc.Close()
+	pc.WriteTo([]byte("denied"), denied.LocalAddr())
+	pc.WriteTo([]byte("allowed"), allowed.LocalAddr())
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if string(buf[:n]) != "allowed" || from.String() != allowed.LocalAddr().String() {
+		t.Errorf("ReadFrom() = %q from %v", buf[:n], from)
+	}
+}
+
+func TestUDPAssociateDenyLoopbackTargets(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+	s := &SOCKS5Server{Rules: Rules{
+		{Action: RuleDeny, Networks: []*net.IPNet{mustCIDR("127.0.0.0/8")}},
+		{Action: RuleAllow},
+	}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	//回环地址上的客户端仍可建立关联，只是发往回环目标的数据报被丢弃
+	pc, err := (&Client{ProxyAddr: addr}).ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer pc.Close()
+	pc.WriteTo([]byte("ping"), echo.LocalAddr())
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := pc.ReadFrom(make([]byte, 16)); err == nil {
+		t.Errorf("datagram to denied target relayed, got %d bytes back", n)
+	}
+}
@@ -0,0 +1,234 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type UpstreamType int
+
+const (
+	UpstreamSOCKS5 UpstreamType = iota
+	UpstreamSOCKS4A
+	UpstreamHTTP
+)
+
+// Upstream 是代理链中的一跳
+type Upstream struct {
+	Type UpstreamType
+	Addr string
+	// SOCKS5 和 HTTP 的认证信息，SOCKS4a 只使用 Username 作为 USERID
+	Username string
+	Password string
+}
+
+// Router 为请求选择上游代理链，返回空表示直连
+type Router interface {
+	Route(req *Request) []Upstream
+}
+
+func (r Rules) Route(req *Request) []Upstream {
+	if rule := r.Match(req); rule != nil {
+		return rule.Upstreams
+	}
+	return nil
+}
+
+// ProxyHeaderRouter 决定连接目标后是否发送携带客户端地址的 PROXY 协议头，
+// 返回协议版本，0 表示不发送
+type ProxyHeaderRouter interface {
+	ProxyProtocol(req *Request) int
+}
+
+func (r Rules) ProxyProtocol(req *Request) int {
+	if rule := r.Match(req); rule != nil {
+		return rule.ProxyProtocol
+	}
+	return 0
+}
+
+// dialChain 依次经过 chain 中的每个代理连接 address，chain 为空时直连
+func (s *SOCKS5Server) dialChain(ctx context.Context, chain []Upstream, address string) (net.Conn, error) {
+	if len(chain) == 0 {
+		return s.dial(ctx, "tcp", address)
+	}
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+	conn, err := s.dial(ctx, "tcp", chain[0].Addr)
+	if err != nil {
+		//无法连接上游代理
+		return nil, &ReplyError{Code: serverFailure, Err: err}
+	}
+	for i := range chain {
+		next := address
+		if i+1 < len(chain) {
+			next = chain[i+1].Addr
+		}
+		conn, err = chain[i].connect(ctx, conn, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// connect 在已连接到该代理的 conn 上请求连接 address，失败时关闭 conn
+func (u *Upstream) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	var err error
+	result := conn
+	switch u.Type {
+	case UpstreamSOCKS5:
+		err = u.connectSOCKS5(ctx, conn, address)
+	case UpstreamSOCKS4A:
+		err = withConnContext(ctx, conn, func() error {
+			return u.connectSOCKS4A(conn, address)
+		})
+	case UpstreamHTTP:
+		err = withConnContext(ctx, conn, func() error {
+			result, err = u.connectHTTP(conn, address)
+			return err
+		})
+	default:
+		err = fmt.Errorf("unknown upstream type %d", u.Type)
+	}
+	if err != nil {
+		conn.Close()
+		if _, ok := err.(*ReplyError); !ok {
+			err = &ReplyError{Code: serverFailure, Err: err}
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+func (u *Upstream) connectSOCKS5(ctx context.Context, conn net.Conn, address string) error {
+	req, err := NewClientRequestMassageFromAddress(Connect, address)
+	if err != nil {
+		return err
+	}
+	c := &Client{Username: u.Username, Password: u.Password}
+	_, err = c.handshakeContext(ctx, conn, req)
+	return err
+}
+
+func (u *Upstream) connectSOCKS4A(conn net.Conn, address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ErrInvalidPort
+	}
+	buf := []byte{SOCKS4Version, Connect, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:], uint16(portNum))
+	parsed := net.ParseIP(host)
+	ip := parsed.To4()
+	if parsed != nil && ip == nil {
+		//SOCKS4 不支持 IPv6 目标
+		return &ReplyError{Code: addrTypeNotSupported}
+	}
+	if ip == nil {
+		//SOCKS4a：DSTIP 设为 0.0.0.x，域名放在 USERID 之后
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	buf = append(buf, ip...)
+	buf = append(buf, u.Username...)
+	buf = append(buf, 0)
+	if parsed == nil {
+		buf = append(buf, host...)
+		buf = append(buf, 0)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks4Granted {
+		return &ReplyError{Code: hostUnreachable, Err: fmt.Errorf("socks4 reply 0x%02x", reply[1])}
+	}
+	return nil
+}
+
+func (u *Upstream) connectHTTP(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username + ":" + u.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ReplyError{Code: httpReplyCode(resp.StatusCode), Err: fmt.Errorf("http proxy: %s", resp.Status)}
+	}
+	if br.Buffered() > 0 {
+		//保留已经读入缓冲区的目标数据
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func httpReplyCode(status int) uint8 {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return ruleFailure
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return hostUnreachable
+	case http.StatusGatewayTimeout:
+		return ttlExpired
+	}
+	return serverFailure
+}
+
+// bufferedConn 先读出缓冲区中剩余的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// withConnContext 在 fn 执行期间让 conn 遵守 ctx 的截止时间和取消
+func withConnContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err := fn()
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// httpConnectProxy 启动一个只支持 CONNECT 的 HTTP 代理
+func httpConnectProxy(t *testing.T, auth string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				(&SOCKS5Server{}).tcpForward(context.Background(), c, target, &session{})
+			}()
+		}
+	}()
+	return l
+}
+
+// socks4aProxy 启动一个只支持 CONNECT 的 SOCKS4a 代理
+func socks4aProxy(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				head := make([]byte, 8)
+				if _, err := io.ReadFull(r, head); err != nil {
+					return
+				}
+				r.ReadString(0)
+				host := net.IP(head[4:8]).String()
+				if head[4] == 0 {
+					domain, _ := r.ReadString(0)
+					host = strings.TrimSuffix(domain, "\x00")
+				}
+				port := int(head[2])<<8 | int(head[3])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					c.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				c.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+				(&SOCKS5Server{}).tcpForward(context.Background(), c, target, &session{})
+			}()
+		}
+	}()
+	return l
+}
+
+func TestUpstreamChain(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	//第一跳：需要认证的 SOCKS5，负责解析 echo.test
+	hop1 := &SOCKS5Server{
+		Credentials: StaticCredentials{"user": "pass"},
+		Resolver:    staticResolver{"echo.test": net.IPv4(127, 0, 0, 1)},
+	}
+	hop1Addr, _ := startServer(t, hop1)
+	defer hop1.Close()
+	httpProxy := httpConnectProxy(t, "user:pass")
+	defer httpProxy.Close()
+	socks4 := socks4aProxy(t)
+	defer socks4.Close()
+
+	tests := []struct {
+		name   string
+		chain  []Upstream
+		target string
+	}{
+		{
+			name:   "SOCKS5",
+			chain:  []Upstream{{Type: UpstreamSOCKS5, Addr: hop1Addr, Username: "user", Password: "pass"}},
+			target: net.JoinHostPort("echo.test", strconv.Itoa(port)),
+		},
+		{
+			name:   "HTTP",
+			chain:  []Upstream{{Type: UpstreamHTTP, Addr: httpProxy.Addr().String(), Username: "user", Password: "pass"}},
+			target: echo.Addr().String(),
+		},
+		{
+			name:   "SOCKS4a",
+			chain:  []Upstream{{Type: UpstreamSOCKS4A, Addr: socks4.Addr().String()}},
+			target: net.JoinHostPort("localhost", strconv.Itoa(port)),
+		},
+		{
+			name: "HTTP then SOCKS5",
+			chain: []Upstream{
+				{Type: UpstreamHTTP, Addr: httpProxy.Addr().String(), Username: "user", Password: "pass"},
+				{Type: UpstreamSOCKS5, Addr: hop1Addr, Username: "user", Password: "pass"},
+			},
+			target: net.JoinHostPort("echo.test", strconv.Itoa(port)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SOCKS5Server{Rules: Rules{{Action: RuleAllow, Upstreams: tt.chain}}}
+			addr, _ := startServer(t, s)
+			defer s.Close()
+
+			conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", tt.target)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+			echoRoundTrip(t, conn)
+		})
+	}
+}
+
+func TestUpstreamPerRule(t *testing.T) {
+	echo := tcpEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+	hop := &SOCKS5Server{Resolver: staticResolver{"zone-a.test": net.IPv4(127, 0, 0, 1)}}
+	hopAddr, _ := startServer(t, hop)
+	defer hop.Close()
+
+	//zone-a.test 只有上游能解析，其余直连
+	s := &SOCKS5Server{
+		Resolver: staticResolver{},
+		Rules: Rules{
+			{Action: RuleAllow, Domains: []string{"zone-a.test"}, Upstreams: []Upstream{{Type: UpstreamSOCKS5, Addr: hopAddr}}},
+			{Action: RuleAllow},
+		},
+	}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+	c := &Client{ProxyAddr: addr}
+
+	for _, target := range []string{net.JoinHostPort("zone-a.test", strconv.Itoa(port)), echo.Addr().String()} {
+		conn, err := c.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("Dial(%s) error = %v", target, err)
+		}
+		echoRoundTrip(t, conn)
+		conn.Close()
+	}
+}
+
+func TestUpstreamReplyCodes(t *testing.T) {
+	httpProxy := httpConnectProxy(t, "user:pass")
+	defer httpProxy.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		upstream Upstream
+		want     uint8
+	}{
+		{"HTTP auth required", Upstream{Type: UpstreamHTTP, Addr: httpProxy.Addr().String()}, ruleFailure},
+		{"HTTP bad gateway", Upstream{Type: UpstreamHTTP, Addr: httpProxy.Addr().String(), Username: "user", Password: "pass"}, hostUnreachable},
+		{"Upstream down", Upstream{Type: UpstreamSOCKS5, Addr: closed.Addr().String()}, serverFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SOCKS5Server{Rules: Rules{{Action: RuleAllow, Upstreams: []Upstream{tt.upstream}}}}
+			addr, _ := startServer(t, s)
+			defer s.Close()
+
+			_, err := (&Client{ProxyAddr: addr}).Dial("tcp", closed.Addr().String())
+			var replyErr *ReplyError
+			if !errors.As(err, &replyErr) || replyErr.Code != tt.want {
+				t.Errorf("Dial() error = %v, want reply %d", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamSOCKS4AIPv6(t *testing.T) {
+	proxy := socks4aProxy(t)
+	defer proxy.Close()
+
+	s := &SOCKS5Server{Rules: Rules{{Action: RuleAllow, Upstreams: []Upstream{{Type: UpstreamSOCKS4A, Addr: proxy.Addr().String()}}}}}
+	addr, _ := startServer(t, s)
+	defer s.Close()
+
+	_, err := (&Client{ProxyAddr: addr}).Dial("tcp", "[2001:db8::1]:80")
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != addrTypeNotSupported {
+		t.Errorf("Dial() error = %v, want reply %d", err, addrTypeNotSupported)
+	}
+}